@@ -30,6 +30,37 @@ interface HttpEvent
      */
     public function acceptClient(): mixed;
 
+    /**
+     * Read the next message the handler server wrote on a client socket. With the persistent
+     * protocol the handler server keeps the connection and writes every request message on it.
+     * 
+     * @param resource $client Client socket from acceptClient()
+     * @return string|false The message (request or shutdown), FALSE when the handler server closed the connection
+     */
+    public function receive(mixed $client): string|false;
+
+    /**
+     * Check if the handler server sent a shutdown message instead of a relayed request
+     * 
+     * @param mixed $data Message read from the client socket
+     * @return bool TRUE if the handler server is shutting down
+     */
+    public function isShutdownMessage(mixed $data): bool;
+
+    /**
+     * How often heartbeats must be sent to the handler server
+     * 
+     * @return int Second(s), 0 if the handler server does not expect heartbeats
+     */
+    public function getHeartbeatInterval(): int;
+
+    /**
+     * Tell the handler server this process is alive, so it keeps the resource(s) registered
+     * 
+     * @return bool TRUE if the handler server knows this process, FALSE otherwise
+     */
+    public function heartbeat(): bool;
+
     /**
      * Message that represents failure to resume flow. Client must try again with another request.
      * 
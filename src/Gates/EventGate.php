@@ -119,14 +119,47 @@ abstract class EventGate extends Gate implements EventGateContract
                 $reactor->onReadable(
                     $event->getResource(),
                     function ($stream, $reactor) use ($event) {
-                        $client = $event->acceptClient();
-                        $data = fgets($client);
-                        if ($event->resolve($data)) {
-                            $reactor->stopRun();
-                            $this->winner = $event;
-                        }
+                        // One message per connection (per-request protocol) or many (persistent protocol)
+                        $reactor->onReadable(
+                            $event->acceptClient(),
+                            function ($client, $reactor) use ($event, $stream) {
+                                $data = $event->receive($client);
+                                if (false === $data) {
+                                    // Handler server closed the connection
+                                    $reactor->remove($client);
+                                    fclose($client);
+                                    return;
+                                }
+                                if ($event->isShutdownMessage($data)) {
+                                    if (json_decode($data, true)['persisted'] ?? false) {
+                                        // Registration kept, the next HTTP server instance relays requests for this event
+                                        Logger::info('HTTP handler server restarting');
+                                        return;
+                                    }
+                                    // HTTP server is shutting down, no more requests will be relayed for this event
+                                    Logger::info('HTTP handler server shutting down');
+                                    $reactor->remove($client);
+                                    $reactor->remove($stream);
+                                    return;
+                                }
+                                if ($event->resolve($data)) {
+                                    $reactor->stopRun();
+                                    $this->winner = $event;
+                                }
+                            }
+                        );
                     }
                 );
+                if ($event->getHeartbeatInterval() > 0) {
+                    // Tell handler server this process is alive
+                    $reactor->addTimer(
+                        $event->getHeartbeatInterval(),
+                        function ($reactor) use ($event) {
+                            $event->heartbeat();
+                        },
+                        true
+                    );
+                }
                 if (!is_null($maxFails)) {
                     // Set heartbeat to check if handler server is responding
                     $reactor->addTimer(
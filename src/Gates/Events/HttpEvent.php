@@ -52,11 +52,51 @@ abstract class HttpEvent implements GateEventContract, HttpEventContract, Stream
      */
     private mixed $client;
 
+    /**
+     * @var string $requestId ID of the last request message read from the client, echoed in the response message
+     */
+    private string $requestId = '';
+
     /**
      * @var int $timeout In seconds, how long the HTTP server keeps this resource, default is TIMEOUT seconds
      */
     protected int $timeout;
 
+    /**
+     * @var string $mode How many accepted requests the HTTP server relays: single (default), multi or persistent
+     */
+    protected string $mode;
+
+    /**
+     * @var int $shots In multi mode, how many accepted requests before the HTTP server removes this resource
+     */
+    protected int $shots;
+
+    /**
+     * @var array $registerOptions Additional register command options, e.g. queue_depth, queue_wait and response_file
+     */
+    protected array $registerOptions = [];
+
+    /**
+     * @var string $token Token generated by the HTTP server on register (one_time authentication scheme)
+     */
+    protected string $token;
+
+    /**
+     * @var bool $generatePath The HTTP server generates an unguessable path, $path is used as prefix
+     */
+    protected bool $generatePath = false;
+
+    /**
+     * @var string $expiresAt When the generated path expires (RFC 3339)
+     */
+    protected string $expiresAt;
+
+    /**
+     * @var int $heartbeatInterval In seconds, how often heartbeats are sent to the HTTP server, 0 disables owner liveness checks
+     */
+    protected int $heartbeatInterval = 0;
+
     /**
      * @var bool $resourceClosed Prevent wait forever on socket connect to server when cleaning up resource.
      */
@@ -73,18 +113,32 @@ abstract class HttpEvent implements GateEventContract, HttpEventContract, Stream
         // Fresh start
         @unlink($this->handlerSrvSockFile);
         // Register command
-        $cmd = json_encode([
+        $cmd = [
             'command' => 'register',
             'path' => $this->path,
             'socket_file' => $this->handlerSrvSockFile,
             'external_process_id' => INSTANCE_UID,
             'allowed_methods' => $this->allowedMethods,
-            'timeout' => isset($this->timeout) ? $this->timeout : self::TIMEOUT
-        ]) . "\n";
+            'timeout' => isset($this->timeout) ? $this->timeout : self::TIMEOUT,
+            'mode' => isset($this->mode) ? $this->mode : 'single',
+            'shots' => isset($this->shots) ? $this->shots : 0,
+            'generate_path' => $this->generatePath,
+            'heartbeat_interval' => $this->heartbeatInterval
+        ] + $this->registerOptions;
         $resp = $this->sendCommandToHandlerServer($cmd);
         if (!$resp['ok']) {
             throw new RuntimeException("Could not register path {$this->path}: {$resp['error']}");
         }
+        if (isset($resp['token'])) {
+            $this->token = $resp['token'];
+        }
+        if (isset($resp['path'])) {
+            // Deregister using the generated path
+            $this->path = $resp['path'];
+        }
+        if (isset($resp['expires_at'])) {
+            $this->expiresAt = $resp['expires_at'];
+        }
 
         Logger::info("Registered path: {$this->path}");
     }
@@ -95,14 +149,14 @@ abstract class HttpEvent implements GateEventContract, HttpEventContract, Stream
     private function deregisterPathWithHandlerServer(): void
     {
         // Deregister command
-        $cmd = json_encode([
+        $cmd = [
             'command' => 'deregister',
             'path' => $this->path,
             'socket_file' => "",
             'external_process_id' => INSTANCE_UID,
             'allowed_methods' => [],
             'timeout' => 0
-        ]) . "\n";
+        ];
         $resp = $this->sendCommandToHandlerServer($cmd);
         if ($resp['ok']) {
             Logger::info("Deregistered path: {$this->path}");
@@ -118,9 +172,21 @@ abstract class HttpEvent implements GateEventContract, HttpEventContract, Stream
      * 
      * @throws RuntimeException If unable to open command pipe file or register paths with HTTP server
      */
-    private function sendCommandToHandlerServer(string $cmd): array
+    private function sendCommandToHandlerServer(array $cmd): array
     {
-        $cmdSockFile = Config::getApplicationSettings()->get('http.server.command_socket_path');
+        $settings = Config::getApplicationSettings();
+        $cmdSockFile = $settings->get('http.server.command_socket_path');
+        if ($settings->has('http.server.command_secret_file')) {
+            // Handler server rejects commands without the shared secret
+            $secret = @file_get_contents($settings->get('http.server.command_secret_file'));
+            if (false === $secret) {
+                throw new RuntimeException('Could not read command secret file');
+            }
+
+            $cmd['secret'] = trim($secret);
+        }
+
+        $cmd = json_encode($cmd) . "\n";
         $sock = socket_create(AF_UNIX, SOCK_STREAM, 0);
         if (!$sock) {
             throw new RuntimeException("Socket create fail: {$cmdSockFile}");
@@ -248,12 +314,7 @@ abstract class HttpEvent implements GateEventContract, HttpEventContract, Stream
         mixed $message
     ): bool {
         $resp = new ResponseMessageToHttpRequest(true, $code, $status, $message);
-        if (false === fwrite($this->client, json_encode($resp) . "\n")) {
-            $this->closeResource();
-            throw new RuntimeException("Could not write \"accepted\" message to handler server");
-        }
-
-        fflush($this->client);
+        $this->send($resp, 'accepted');
         return true;
     }
 
@@ -263,13 +324,97 @@ abstract class HttpEvent implements GateEventContract, HttpEventContract, Stream
         mixed $message
     ): bool {
         $resp = new ResponseMessageToHttpRequest(false, $code, $status, $message);
-        if (false === fwrite($this->client, json_encode($resp) . "\n")) {
+        $this->send($resp, 'try again');
+        return false;
+    }
+
+    /**
+     * Send a custom response message, the HTTP server writes its status code, headers and body to the client.
+     * 
+     * @throws RuntimeException If unable to send message to HTTP server
+     * @return bool The response message ok flag, TRUE signals the reactor to stop waiting on events
+     */
+    public function reply(ResponseMessageToHttpRequest $resp): bool
+    {
+        $this->send($resp, 'reply');
+        return $resp->jsonSerialize()['ok'];
+    }
+
+    /**
+     * Write the response message to the client that sent the last request message.
+     * The request ID is echoed, the handler server matches responses to requests with it (persistent protocol).
+     * 
+     * @throws RuntimeException If unable to send message to HTTP server
+     */
+    private function send(ResponseMessageToHttpRequest $resp, string $what): void
+    {
+        $msg = $resp->jsonSerialize();
+        if ('' !== $this->requestId) {
+            $msg = ['request_id' => $this->requestId] + $msg;
+        }
+        if (false === fwrite($this->client, json_encode($msg) . "\n")) {
             $this->closeResource();
-            throw new RuntimeException('Could not write "try again" message to handler server');
+            throw new RuntimeException("Could not write \"{$what}\" message to handler server");
         }
 
         fflush($this->client);
-        return false;
+    }
+
+    /**
+     * Extend how long the HTTP server keeps this resource
+     * 
+     * @param int|null $timeout Second(s) from now, NULL for the registered timeout
+     * @return bool TRUE if renewed, FALSE otherwise (e.g. resource already removed)
+     */
+    public function renew(?int $timeout = null): bool
+    {
+        $cmd = [
+            'command' => is_null($timeout) ? 'touch' : 'renew',
+            'path' => $this->path,
+            'external_process_id' => INSTANCE_UID,
+            'timeout' => $timeout ?? 0
+        ];
+        $resp = $this->sendCommandToHandlerServer($cmd);
+        if (!$resp['ok']) {
+            Logger::info("Could not renew path {$this->path}: {$resp['error']}");
+            return false;
+        }
+        if (isset($resp['expires_at'])) {
+            $this->expiresAt = $resp['expires_at'];
+        }
+
+        return true;
+    }
+
+    public function isShutdownMessage(mixed $data): bool
+    {
+        if (!is_string($data) || !json_validate($data)) {
+            return false;
+        }
+
+        $msg = json_decode($data, true);
+        return is_array($msg) && ($msg['event'] ?? null) === 'shutdown';
+    }
+
+    public function getHeartbeatInterval(): int
+    {
+        return $this->heartbeatInterval;
+    }
+
+    public function heartbeat(): bool
+    {
+        $cmd = [
+            'command' => 'heartbeat',
+            'external_process_id' => INSTANCE_UID
+        ];
+        try {
+            $resp = $this->sendCommandToHandlerServer($cmd);
+        } catch (RuntimeException $e) {
+            Logger::info("Could not send heartbeat: {$e->getMessage()}");
+            return false;
+        }
+
+        return $resp['ok'];
     }
 
     public function acceptClient(): mixed
@@ -281,5 +426,19 @@ abstract class HttpEvent implements GateEventContract, HttpEventContract, Stream
         return $this->client;
     }
 
+    public function receive(mixed $client): string|false
+    {
+        $data = fgets($client);
+        if (false === $data) {
+            return false;
+        }
+
+        // Responses go to the connection (and request) this message came from
+        $this->client = $client;
+        $msg = json_validate($data) ? json_decode($data, true) : null;
+        $this->requestId = is_array($msg) && is_string($msg['request_id'] ?? null) ? $msg['request_id'] : '';
+        return $data;
+    }
+
     abstract public function resolve(mixed $mixed = null): bool;
 }
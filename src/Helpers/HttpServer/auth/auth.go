@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authentication schemes
+const (
+	Bearer  = "bearer"   // Authorization: Bearer <token>, one of Tokens
+	APIKey  = "api_key"  // <Header>: <token>, one of Tokens
+	Basic   = "basic"    // Authorization: Basic, user and password checked against bcrypt hashes in Users
+	OneTime = "one_time" // Authorization: Bearer <token>, token generated by the server, revoked after use
+)
+
+// Default API key header
+const DefaultHeader = "X-API-Key"
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Options of the authentication of a resource, set in the register command
+type Options struct {
+	Scheme  string            `json:"scheme"`
+	Tokens  []string          `json:"tokens,omitempty"` // Bearer and API key schemes
+	Header  string            `json:"header,omitempty"` // API key header, default DefaultHeader
+	Users   map[string]string `json:"users,omitempty"`  // Basic scheme, user => bcrypt hash
+	revoked atomic.Bool       // One time token was used
+}
+
+func (o *Options) Validate() error {
+	switch o.Scheme {
+	case Bearer, APIKey:
+		if len(o.Tokens) == 0 || slices.Contains(o.Tokens, "") {
+			return errors.New("authentication tokens are mandatory")
+		}
+	case Basic:
+		if len(o.Users) == 0 {
+			return errors.New("authentication users are mandatory")
+		}
+		for _, hash := range o.Users {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return errors.New("invalid bcrypt hash")
+			}
+		}
+	case OneTime:
+		if len(o.Tokens) > 0 {
+			return errors.New("one time token is generated by the server")
+		}
+	default:
+		return errors.New("invalid authentication scheme")
+	}
+	return nil
+}
+
+/* Generate the one time token, which the external process hands over to the client.
+ * Returns an empty string for the other schemes. */
+func (o *Options) Prepare() (string, error) {
+	if o.Scheme != OneTime {
+		return "", nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	o.Tokens = []string{token}
+	return token, nil
+}
+
+// One time token can't be used again
+func (o *Options) Revoke() {
+	if o.Scheme == OneTime {
+		o.revoked.Store(true)
+	}
+}
+
+// One time token can be used again, e.g. the request it authenticated was not relayed
+func (o *Options) Restore() {
+	if o.Scheme == OneTime {
+		o.revoked.Store(false)
+	}
+}
+
+func (o *Options) Revoked() bool {
+	return o.revoked.Load()
+}
+
+// Check the request credentials. A valid one time token is revoked, so concurrent requests can't use it.
+func Check(o *Options, r *http.Request) error {
+	switch o.Scheme {
+	case Bearer, OneTime:
+		if o.revoked.Load() {
+			return ErrUnauthorized
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return ErrUnauthorized
+		}
+		if err := matchToken(o.Tokens, strings.TrimSpace(token)); err != nil {
+			return err
+		}
+		if o.Scheme == OneTime && !o.revoked.CompareAndSwap(false, true) {
+			return ErrUnauthorized // Used by a concurrent request
+		}
+		return nil
+
+	case APIKey:
+		header := o.Header
+		if header == "" {
+			header = DefaultHeader
+		}
+		return matchToken(o.Tokens, strings.TrimSpace(r.Header.Get(header)))
+
+	case Basic:
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return ErrUnauthorized
+		}
+		hash, found := o.Users[user]
+		if !found {
+			return ErrUnauthorized
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+// WWW-Authenticate header value for 401 responses, empty if the scheme has none
+func (o *Options) Challenge() string {
+	switch o.Scheme {
+	case Bearer, OneTime:
+		return `Bearer realm="flows"`
+	case Basic:
+		return `Basic realm="flows"`
+	}
+	return ""
+}
+
+// Constant time comparison against every token
+func matchToken(tokens []string, token string) error {
+	if token == "" {
+		return ErrUnauthorized
+	}
+
+	match := 0
+	for _, t := range tokens {
+		match |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+	}
+	if match != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings
+const (
+	Gzip     = "gzip"
+	Deflate  = "deflate"
+	Brotli   = "br"
+	Identity = "identity"
+)
+
+var ErrUnsupported = errors.New("unsupported content encoding")
+
+// Decompression failure, the request body is not valid for its content encoding
+type Error struct {
+	Err error
+}
+
+func (e *Error) Error() string {
+	return "invalid compressed content: " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+/* NewReader decodes a body with the Content-Encoding header value. Codings are listed
+ * in the order they were applied, so they are removed in reverse. */
+func NewReader(contentEncoding string, body io.Reader) (io.Reader, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case Gzip, "x-gzip":
+			body, err = gzip.NewReader(body)
+		case Deflate:
+			body, err = newDeflateReader(body)
+		case Brotli:
+			body = brotli.NewReader(body)
+		case Identity, "":
+		default:
+			return nil, ErrUnsupported
+		}
+		if err != nil {
+			return nil, wrap(err)
+		}
+	}
+	return &reader{body}, nil
+}
+
+/* "deflate" is the zlib format, but some clients send raw deflate data:
+ * the zlib header is checked to tell them apart. */
+func newDeflateReader(body io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(body)
+	head, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+type reader struct {
+	src io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if err != nil && err != io.EOF {
+		err = wrap(err)
+	}
+	return n, err
+}
+
+// Body size limit errors are kept as they are, the others are decompression failures
+func wrap(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) || err == io.EOF {
+		return err
+	}
+	return &Error{err}
+}
+
+/* Negotiate picks the response content coding from the Accept-Encoding header value,
+ * preferring brotli over gzip over deflate at equal quality. Empty string means no compression. */
+func Negotiate(acceptEncoding string) string {
+	best := ""
+	bestQ := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if coding == "*" {
+			coding = Brotli
+		}
+		if q <= 0 || !slices.Contains([]string{Brotli, Gzip, Deflate}, coding) {
+			continue
+		}
+		if q > bestQ || (q == bestQ && rank(coding) < rank(best)) {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+func rank(coding string) int {
+	switch coding {
+	case Brotli:
+		return 0
+	case Gzip:
+		return 1
+	case Deflate:
+		return 2
+	}
+	return 3
+}
+
+// NewWriter compresses what is written to w with the content coding
+func NewWriter(coding string, w io.Writer) io.WriteCloser {
+	switch coding {
+	case Brotli:
+		return brotli.NewWriter(w)
+	case Gzip:
+		return gzip.NewWriter(w)
+	default:
+		return zlib.NewWriter(w)
+	}
+}
@@ -0,0 +1,96 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Body encoded with the codings, in the order they are listed
+func encode(t *testing.T, data string, codings ...string) []byte {
+	t.Helper()
+	b := []byte(data)
+	for _, coding := range codings {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		if coding == "raw-deflate" {
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		} else {
+			w = NewWriter(coding, &buf)
+		}
+		w.Write(b)
+		w.Close()
+		b = buf.Bytes()
+	}
+	return b
+}
+
+func TestNewReader(t *testing.T) {
+	const data = `{"hello":"world"}`
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		fail     string // unsupported or invalid
+	}{
+		{"gzip", "gzip", encode(t, data, Gzip), ""},
+		{"x-gzip", "X-Gzip", encode(t, data, Gzip), ""},
+		{"deflate", "deflate", encode(t, data, Deflate), ""},
+		{"raw deflate", "deflate", encode(t, data, "raw-deflate"), ""},
+		{"brotli", "br", encode(t, data, Brotli), ""},
+		{"identity", "identity", []byte(data), ""},
+		{"stacked", "gzip, br", encode(t, data, Gzip, Brotli), ""},
+		{"unsupported", "compress", encode(t, data, Gzip), "unsupported"},
+		{"unsupported in a list", "gzip, zstd", encode(t, data, Gzip), "unsupported"},
+		{"not gzip", "gzip", []byte(data), "invalid"},
+		{"truncated gzip", "gzip", encode(t, data, Gzip)[:12], "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(tt.encoding, bytes.NewReader(tt.body))
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(r)
+			}
+			var invalid *Error
+			switch tt.fail {
+			case "":
+				if err != nil || string(got) != data {
+					t.Errorf("decoded = %q, %v, want %q", got, err, data)
+				}
+			case "unsupported":
+				if !errors.Is(err, ErrUnsupported) {
+					t.Errorf("error = %v, want %v", err, ErrUnsupported)
+				}
+			case "invalid":
+				if !errors.As(err, &invalid) {
+					t.Errorf("error = %v, want a decompression error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", Gzip},
+		{"gzip, deflate, br", Brotli},
+		{"deflate, gzip", Gzip},
+		{"br;q=0.5, gzip", Gzip},
+		{"gzip;q=0, deflate", Deflate},
+		{"*", Brotli},
+		{"GZIP", Gzip},
+	}
+	for _, tt := range tests {
+		if got := Negotiate(tt.accept); got != tt.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
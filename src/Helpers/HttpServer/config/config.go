@@ -0,0 +1,277 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Server modes
+const (
+	ModeEphemeral = "ephemeral" // Shut down after IdleShutdown without resources
+	ModeDaemon    = "daemon"    // Run until stopped
+)
+
+// Environment variables prefix, e.g. FLOWS_HTTP_LISTENER_ADDRESS for listener.address
+const EnvPrefix = "FLOWS_HTTP_"
+
+/* Config holds the server settings. Precedence, lowest first: defaults, configuration
+ * file, FLOWS_HTTP_* environment variables, command line flags. */
+type Config struct {
+	ServerUID string   `json:"server_uid" yaml:"server_uid" toml:"server_uid"`
+	Mode      string   `json:"mode" yaml:"mode" toml:"mode"` // ephemeral (default) or daemon
+	Listener  Listener `json:"listener" yaml:"listener" toml:"listener"`
+	Timeouts  Timeouts `json:"timeouts" yaml:"timeouts" toml:"timeouts"`
+	Limits    Limits   `json:"limits" yaml:"limits" toml:"limits"`
+	Logging   Logging  `json:"logging" yaml:"logging" toml:"logging"`
+	Security  Security `json:"security" yaml:"security" toml:"security"`
+	Registry  Registry `json:"registry" yaml:"registry" toml:"registry"`
+	Spool     Spool    `json:"spool" yaml:"spool" toml:"spool"`
+}
+
+type Listener struct {
+	Address           string `json:"address" yaml:"address" toml:"address"`                                     // HTTP requests
+	CommandSocket     string `json:"command_socket" yaml:"command_socket" toml:"command_socket"`                // Unix socket file for commands
+	CommandSocketMode string `json:"command_socket_mode" yaml:"command_socket_mode" toml:"command_socket_mode"` // Octal
+	ControlAddress    string `json:"control_address" yaml:"control_address" toml:"control_address"`             // Control API, empty => disabled
+}
+
+type Timeouts struct {
+	ReadExternalProcess int      `json:"read_external_process" yaml:"read_external_process" toml:"read_external_process"` // Seconds
+	IdleShutdown        Duration `json:"idle_shutdown" yaml:"idle_shutdown" toml:"idle_shutdown"`                         // Ephemeral mode, without resources (also at startup)
+	Drain               Duration `json:"drain" yaml:"drain" toml:"drain"`                                                 // On SIGINT/SIGTERM, wait for requests in flight
+	DrainPoll           Duration `json:"drain_poll" yaml:"drain_poll" toml:"drain_poll"`                                  // While draining, check for requests in flight this often
+}
+
+type Limits struct {
+	MaxBodySize    int64 `json:"max_body_size" yaml:"max_body_size" toml:"max_body_size"`       // Bytes
+	SpillThreshold int64 `json:"spill_threshold" yaml:"spill_threshold" toml:"spill_threshold"` // Bytes
+}
+
+type Logging struct {
+	File string `json:"file" yaml:"file" toml:"file"` // Append log lines to this file, empty => standard error
+}
+
+type Security struct {
+	TLSCert           string `json:"tls_cert" yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey            string `json:"tls_key" yaml:"tls_key" toml:"tls_key"`
+	TLSClientCA       string `json:"tls_client_ca" yaml:"tls_client_ca" toml:"tls_client_ca"`
+	CommandAllowUID   string `json:"command_allow_uid" yaml:"command_allow_uid" toml:"command_allow_uid"` // Comma separated
+	CommandAllowGID   string `json:"command_allow_gid" yaml:"command_allow_gid" toml:"command_allow_gid"` // Comma separated
+	CommandSecretFile string `json:"command_secret_file" yaml:"command_secret_file" toml:"command_secret_file"`
+	ControlTokenFile  string `json:"control_token_file" yaml:"control_token_file" toml:"control_token_file"`
+}
+
+type Registry struct {
+	File string `json:"file" yaml:"file" toml:"file"` // Journal of registered resources, replayed at startup, empty => disabled
+}
+
+type Spool struct {
+	Dir           string   `json:"dir" yaml:"dir" toml:"dir"`                                     // Requests stored while their external process is unreachable, empty => disabled
+	DeadLetterDir string   `json:"dead_letter_dir" yaml:"dead_letter_dir" toml:"dead_letter_dir"` // Requests not delivered after max_attempts, empty => dir/dead-letter
+	MaxAttempts   int      `json:"max_attempts" yaml:"max_attempts" toml:"max_attempts"`          // Delivery attempts, including the first one
+	Backoff       Duration `json:"backoff" yaml:"backoff" toml:"backoff"`                         // Wait after the first failed attempt, doubled after each one
+	MaxBackoff    Duration `json:"max_backoff" yaml:"max_backoff" toml:"max_backoff"`
+}
+
+// Duration in configuration files and environment variables is a string like "10ms" or "3s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		Mode: ModeEphemeral,
+		Listener: Listener{
+			Address:           "0.0.0.0:9090",
+			CommandSocket:     os.TempDir() + "/server.cmd.sock",
+			CommandSocketMode: "0600",
+		},
+		Timeouts: Timeouts{
+			ReadExternalProcess: 30,
+			IdleShutdown:        Duration{3 * time.Second},
+			Drain:               Duration{30 * time.Second},
+			DrainPoll:           Duration{50 * time.Millisecond},
+		},
+		Limits: Limits{
+			MaxBodySize:    16 << 20,
+			SpillThreshold: 1 << 20,
+		},
+		Spool: Spool{
+			MaxAttempts: 10,
+			Backoff:     Duration{time.Second},
+			MaxBackoff:  Duration{5 * time.Minute},
+		},
+	}
+}
+
+// Load the defaults overridden by the file, format by extension: .json, .yaml, .yml or .toml
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err = dec.Decode(cfg); errors.Is(err, io.EOF) {
+			err = nil // Empty file
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), cfg)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting %s", md.Undecoded()[0])
+		}
+	default:
+		return nil, errors.New("unsupported configuration file format: " + path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+/* Override settings with FLOWS_HTTP_<SECTION>_<SETTING> environment variables,
+ * lookup is usually os.LookupEnv */
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	walk(reflect.ValueOf(c).Elem(), EnvPrefix, func(name string, v reflect.Value) {
+		s, ok := lookup(name)
+		if !ok {
+			return
+		}
+		if err := set(v, s); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Environment variable names, for help output
+func EnvNames() []string {
+	var names []string
+	walk(reflect.ValueOf(Default()).Elem(), EnvPrefix, func(name string, v reflect.Value) {
+		names = append(names, name)
+	})
+	return names
+}
+
+// Call fn for every setting with its environment variable name
+func walk(v reflect.Value, prefix string, fn func(string, reflect.Value)) {
+	t := v.Type()
+	for i := range t.NumField() {
+		f := v.Field(i)
+		name := prefix + strings.ToUpper(t.Field(i).Tag.Get("json"))
+		if f.Kind() == reflect.Struct && f.Type() != reflect.TypeOf(Duration{}) {
+			walk(f, name+"_", fn)
+			continue
+		}
+		fn(name, f)
+	}
+}
+
+func set(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("invalid integer")
+		}
+		v.SetInt(n)
+	case reflect.Struct: // Duration
+		return v.Addr().Interface().(*Duration).UnmarshalText([]byte(s))
+	default:
+		return errors.New("unsupported setting type")
+	}
+	return nil
+}
+
+// Report every invalid setting
+func (c *Config) Validate() error {
+	var errs []error
+	if c.ServerUID == "" {
+		errs = append(errs, errors.New("server_uid is mandatory"))
+	}
+	if c.Listener.Address == "" {
+		errs = append(errs, errors.New("listener.address is mandatory"))
+	}
+	if c.Listener.CommandSocket == "" {
+		errs = append(errs, errors.New("listener.command_socket is mandatory"))
+	}
+	if mode, err := strconv.ParseUint(c.Listener.CommandSocketMode, 8, 32); err != nil || mode > 0777 {
+		errs = append(errs, errors.New("listener.command_socket_mode must be an octal file mode"))
+	}
+	if c.Listener.ControlAddress != "" && c.Security.ControlTokenFile == "" {
+		errs = append(errs, errors.New("security.control_token_file is mandatory with listener.control_address"))
+	}
+	if c.Timeouts.ReadExternalProcess <= 0 {
+		errs = append(errs, errors.New("timeouts.read_external_process must be greater than 0"))
+	}
+	if c.Timeouts.DrainPoll.Duration <= 0 {
+		errs = append(errs, errors.New("timeouts.drain_poll must be greater than 0"))
+	}
+	if c.Mode != ModeEphemeral && c.Mode != ModeDaemon {
+		errs = append(errs, errors.New("mode must be ephemeral or daemon"))
+	}
+	if c.Timeouts.IdleShutdown.Duration < 0 || c.Timeouts.Drain.Duration < 0 {
+		errs = append(errs, errors.New("timeouts.idle_shutdown and timeouts.drain must not be negative"))
+	}
+	if c.Limits.MaxBodySize <= 0 || c.Limits.SpillThreshold <= 0 {
+		errs = append(errs, errors.New("limits.max_body_size and limits.spill_threshold must be greater than 0"))
+	}
+	if (c.Security.TLSCert == "") != (c.Security.TLSKey == "") {
+		errs = append(errs, errors.New("security.tls_cert and security.tls_key go together"))
+	}
+	if c.Security.TLSClientCA != "" && c.Security.TLSCert == "" {
+		errs = append(errs, errors.New("security.tls_client_ca requires security.tls_cert"))
+	}
+	if c.Spool.Dir != "" {
+		if c.Spool.MaxAttempts < 2 {
+			errs = append(errs, errors.New("spool.max_attempts must be at least 2"))
+		}
+		if c.Spool.Backoff.Duration <= 0 || c.Spool.MaxBackoff.Duration < c.Spool.Backoff.Duration {
+			errs = append(errs, errors.New("spool.backoff must be greater than 0 and not greater than spool.max_backoff"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Effective configuration, YAML
+func (c *Config) String() string {
+	b, _ := yaml.Marshal(c)
+	return string(b)
+}
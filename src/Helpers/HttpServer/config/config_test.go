@@ -0,0 +1,154 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		err     string
+	}{
+		{"json", "c.json", `{"mode": "daemon", "timeouts": {"drain_poll": "20ms"}, "limits": {"max_body_size": 1024}}`, ""},
+		{"yaml", "c.yaml", "mode: daemon\ntimeouts:\n  drain_poll: 20ms\nlimits:\n  max_body_size: 1024\n", ""},
+		{"yml", "c.yml", "mode: daemon\ntimeouts:\n  drain_poll: 20ms\nlimits:\n  max_body_size: 1024\n", ""},
+		{"toml", "c.toml", "mode = \"daemon\"\n[timeouts]\ndrain_poll = \"20ms\"\n[limits]\nmax_body_size = 1024\n", ""},
+		{"unknown json setting", "c.json", `{"mode": "daemon", "accept_tick": "1ms"}`, "unknown field"},
+		{"unknown yaml setting", "c.yaml", "mode: daemon\naccept_tick: 1ms\n", "not found"},
+		{"unknown toml setting", "c.toml", "mode = \"daemon\"\naccept_tick = \"1ms\"\n", "unknown setting"},
+		{"invalid duration", "c.yaml", "timeouts:\n  drain_poll: soon\n", "invalid duration"},
+		{"unsupported format", "c.ini", "mode=daemon", "unsupported configuration file format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeFile(t, tt.file, tt.content))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Mode != ModeDaemon || cfg.Timeouts.DrainPoll.Duration != 20*time.Millisecond || cfg.Limits.MaxBodySize != 1024 {
+				t.Errorf("config = %+v, want the file settings", cfg)
+			}
+			// Settings not in the file keep their defaults
+			if cfg.Timeouts.ReadExternalProcess != Default().Timeouts.ReadExternalProcess {
+				t.Errorf("read_external_process = %d, want the default", cfg.Timeouts.ReadExternalProcess)
+			}
+		})
+	}
+
+	if cfg, err := Load(writeFile(t, "empty.yaml", "")); err != nil || cfg.Mode != ModeEphemeral {
+		t.Errorf("Load() of an empty file = %v, want the defaults", err)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "c.yaml", "mode: daemon\nlimits:\n  max_body_size: 1024\n  spill_threshold: 512\n")
+	tests := []struct {
+		name string
+		env  map[string]string
+		want Config
+	}{
+		{"file over defaults", nil, Config{Mode: ModeDaemon, Limits: Limits{MaxBodySize: 1024, SpillThreshold: 512}, Timeouts: Timeouts{ReadExternalProcess: 30}}},
+		{"environment over file", map[string]string{
+			"FLOWS_HTTP_LIMITS_MAX_BODY_SIZE":           "2048",
+			"FLOWS_HTTP_TIMEOUTS_READ_EXTERNAL_PROCESS": "5",
+			"FLOWS_HTTP_MODE":                           ModeEphemeral,
+		}, Config{Mode: ModeEphemeral, Limits: Limits{MaxBodySize: 2048, SpillThreshold: 512}, Timeouts: Timeouts{ReadExternalProcess: 5}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lookup := func(name string) (string, bool) {
+				v, ok := tt.env[name]
+				return v, ok
+			}
+			if err := cfg.ApplyEnv(lookup); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Mode != tt.want.Mode || cfg.Limits != tt.want.Limits || cfg.Timeouts.ReadExternalProcess != tt.want.Timeouts.ReadExternalProcess {
+				t.Errorf("config = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{"FLOWS_HTTP_TIMEOUTS_DRAIN_POLL", "20ms", ""},
+		{"FLOWS_HTTP_TIMEOUTS_DRAIN_POLL", "soon", "FLOWS_HTTP_TIMEOUTS_DRAIN_POLL"},
+		{"FLOWS_HTTP_LIMITS_MAX_BODY_SIZE", "16MB", "invalid integer"},
+		{"FLOWS_HTTP_SPOOL_DIR", "/var/spool/flows", ""},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		err := cfg.ApplyEnv(func(name string) (string, bool) { return tt.value, name == tt.name })
+		if (err == nil) != (tt.err == "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s=%s error = %v, want %q", tt.name, tt.value, err, tt.err)
+		}
+	}
+
+	names := EnvNames()
+	for _, want := range []string{"FLOWS_HTTP_MODE", "FLOWS_HTTP_TIMEOUTS_DRAIN_POLL", "FLOWS_HTTP_SECURITY_TLS_CLIENT_CA", "FLOWS_HTTP_SPOOL_MAX_BACKOFF"} {
+		if !strings.Contains(strings.Join(names, " "), want) {
+			t.Errorf("EnvNames() has no %s", want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		err    string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no server uid", func(c *Config) { c.ServerUID = "" }, "server_uid is mandatory"},
+		{"socket mode", func(c *Config) { c.Listener.CommandSocketMode = "0800" }, "octal file mode"},
+		{"control without token", func(c *Config) { c.Listener.ControlAddress = "127.0.0.1:9091" }, "control_token_file is mandatory"},
+		{"read timeout", func(c *Config) { c.Timeouts.ReadExternalProcess = 0 }, "read_external_process"},
+		{"drain poll", func(c *Config) { c.Timeouts.DrainPoll.Duration = 0 }, "drain_poll"},
+		{"mode", func(c *Config) { c.Mode = "forever" }, "mode must be"},
+		{"negative idle shutdown", func(c *Config) { c.Timeouts.IdleShutdown.Duration = -time.Second }, "must not be negative"},
+		{"body size", func(c *Config) { c.Limits.MaxBodySize = 0 }, "max_body_size"},
+		{"tls key without certificate", func(c *Config) { c.Security.TLSKey = "k.pem" }, "go together"},
+		{"client CA without certificate", func(c *Config) { c.Security.TLSClientCA = "ca.pem" }, "requires security.tls_cert"},
+		{"spool attempts", func(c *Config) { c.Spool.Dir, c.Spool.MaxAttempts = "/spool", 1 }, "max_attempts"},
+		{"spool backoff", func(c *Config) { c.Spool.Dir, c.Spool.Backoff.Duration = "/spool", time.Hour }, "spool.backoff"},
+		{"every error", func(c *Config) { c.ServerUID, c.Mode = "", "forever" }, "server_uid is mandatory\nmode must be"},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.ServerUID = "uid"
+		tt.change(cfg)
+		err := cfg.Validate()
+		if (err == nil) != (tt.err == "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: Validate() = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
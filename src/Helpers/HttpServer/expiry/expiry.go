@@ -0,0 +1,119 @@
+package expiry
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type item struct {
+	key   string
+	at    time.Time
+	index int // Position in the heap
+}
+
+// Min-heap by deadline
+type items []*item
+
+func (h items) Len() int           { return len(h) }
+func (h items) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h items) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *items) Push(x any) {
+	it := x.(*item)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *items) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
+
+/* Queue holds one deadline per key, the earliest first. The owner waits for
+ * the Next deadline (or a Wake signal), then takes the Due keys. */
+type Queue struct {
+	mu    sync.Mutex
+	heap  items
+	index map[string]*item
+	wake  chan struct{}
+}
+
+func New() *Queue {
+	return &Queue{index: make(map[string]*item), wake: make(chan struct{}, 1)}
+}
+
+// Set the key's deadline, replacing the previous one
+func (q *Queue) Schedule(key string, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if it, ok := q.index[key]; ok {
+		it.at = at
+		heap.Fix(&q.heap, it.index)
+	} else {
+		it = &item{key: key, at: at}
+		heap.Push(&q.heap, it)
+		q.index[key] = it
+	}
+	if q.heap[0].key == key {
+		q.signal() // Earliest deadline moved
+	}
+}
+
+// Forget the key, the owner is woken up (e.g. to notice there is nothing left)
+func (q *Queue) Cancel(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if it, ok := q.index[key]; ok {
+		heap.Remove(&q.heap, it.index)
+		delete(q.index, key)
+	}
+	q.signal()
+}
+
+// Remove and return the keys whose deadline is not after now, earliest first
+func (q *Queue) Due(now time.Time) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var keys []string
+	for len(q.heap) > 0 && !q.heap[0].at.After(now) {
+		it := heap.Pop(&q.heap).(*item)
+		delete(q.index, it.key)
+		keys = append(keys, it.key)
+	}
+	return keys
+}
+
+// Earliest deadline, false if the queue is empty
+func (q *Queue) Next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.heap) == 0 {
+		return time.Time{}, false
+	}
+	return q.heap[0].at, true
+}
+
+// Receives when the earliest deadline changed or a key was cancelled
+func (q *Queue) Wake() <-chan struct{} {
+	return q.wake
+}
+
+// Caller holds q.mu
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default: // Already signalled
+	}
+}
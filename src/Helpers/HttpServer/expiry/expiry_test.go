@@ -0,0 +1,99 @@
+package expiry
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func woken(q *Queue) bool {
+	select {
+	case <-q.Wake():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDue(t *testing.T) {
+	base := time.Unix(1_700_000_000, 0)
+	at := func(s int) time.Time { return base.Add(time.Duration(s) * time.Second) }
+
+	tests := []struct {
+		name     string
+		schedule map[string]int // Key => seconds after base
+		cancel   []string
+		now      int
+		due      []string
+		next     int // -1 => queue empty
+	}{
+		{"empty", nil, nil, 10, nil, -1},
+		{"nothing due", map[string]int{"a": 5}, nil, 4, nil, 5},
+		{"deadline equals now", map[string]int{"a": 5}, nil, 5, []string{"a"}, -1},
+		{"earliest first", map[string]int{"c": 3, "a": 1, "b": 2, "d": 9}, nil, 3, []string{"a", "b", "c"}, 9},
+		{"cancelled", map[string]int{"a": 1, "b": 2}, []string{"a"}, 5, []string{"b"}, -1},
+		{"cancel unknown key", map[string]int{"a": 1}, []string{"x"}, 0, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New()
+			for k, s := range tt.schedule {
+				q.Schedule(k, at(s))
+			}
+			for _, k := range tt.cancel {
+				q.Cancel(k)
+			}
+
+			if due := q.Due(at(tt.now)); !slices.Equal(due, tt.due) {
+				t.Errorf("Due() = %v, want %v", due, tt.due)
+			}
+			next, ok := q.Next()
+			if tt.next < 0 && ok {
+				t.Errorf("Next() = %v, want empty queue", next)
+			} else if tt.next >= 0 && (!ok || !next.Equal(at(tt.next))) {
+				t.Errorf("Next() = %v %v, want %v", next, ok, at(tt.next))
+			}
+		})
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	base := time.Unix(1_700_000_000, 0)
+	q := New()
+	q.Schedule("a", base.Add(time.Second))
+	q.Schedule("b", base.Add(2*time.Second))
+	q.Schedule("a", base.Add(3*time.Second)) // One deadline per key
+
+	if due := q.Due(base.Add(2 * time.Second)); !slices.Equal(due, []string{"b"}) {
+		t.Errorf("Due() = %v, want [b]", due)
+	}
+	if due := q.Due(base.Add(3 * time.Second)); !slices.Equal(due, []string{"a"}) {
+		t.Errorf("Due() = %v, want [a]", due)
+	}
+	if due := q.Due(base.Add(time.Hour)); len(due) != 0 {
+		t.Errorf("Due() = %v, want none, keys are taken once", due)
+	}
+}
+
+func TestWake(t *testing.T) {
+	base := time.Unix(1_700_000_000, 0)
+	q := New()
+
+	q.Schedule("a", base.Add(2*time.Second))
+	if !woken(q) {
+		t.Error("first deadline must wake the owner")
+	}
+	q.Schedule("b", base.Add(3*time.Second))
+	if woken(q) {
+		t.Error("later deadline must not wake the owner")
+	}
+	q.Schedule("b", base.Add(time.Second))
+	q.Schedule("c", base)
+	if !woken(q) || woken(q) {
+		t.Error("earlier deadlines must wake the owner once")
+	}
+	q.Cancel("x")
+	if !woken(q) {
+		t.Error("cancel must wake the owner")
+	}
+}
@@ -4,36 +4,84 @@ package main
 //
 // Features:
 //  - Command socket
-//  - One persistent unix socket connection per handler
-//  - Single-shot handlers
+//  - One unix socket connection per request, or one persistent (multiplexed) connection per handler
+//  - Single-shot, N-shot and persistent handlers
+//  - Static paths and path templates (/orders/{id}/approve, /callbacks/*)
+//  - TLS and mutual TLS listener, certificates reloaded on SIGHUP
+//  - Webhook signature verification (HMAC-SHA256, GitHub, Stripe, Slack)
+//  - Per resource authentication (bearer token, API key, HTTP Basic, one time token)
+//  - Server generated unguessable paths (capability URLs)
+//  - Request decompression (gzip, deflate, brotli) and optional response compression
+//  - Owner liveness: resources of external processes that stop sending heartbeats are removed
+//  - Command socket clients authenticated by peer credentials (uid/gid) and optional shared secret
+//  - Optional HTTP JSON control API (bearer token) on a separate address
+//  - Handlers on unix sockets or TCP (socket file "tcp://host:port", request bodies in the message)
+//  - Ephemeral mode (shut down when idle) or daemon mode (run until stopped)
+//  - Configuration file (YAML, JSON, TOML) and FLOWS_HTTP_* environment variables
+//  - Graceful drain on SIGINT/SIGTERM, resource owners get a shutdown message (type ShutdownMsg)
+//  - Optional registry (journal file): registrations survive a server restart
+//  - Optional spool: requests for unreachable external processes are stored, answered with 202 and delivered later
 //
 // External process protocol for commands (JSON message):
 //  - REGISTER command message (type Command)
 //  - DEREGISTER command message (type Command)
+//  - HEARTBEAT command message (type Command, only ExternalProcessID is used)
+//  - LIST and INSPECT command messages (type Command, INSPECT uses Path), for operators
+//  - DEREGISTER_ALL command message (type Command, all resources of ExternalProcessID)
+//  - RENEW and TOUCH command messages (type Command, RENEW uses Timeout)
+//  - UPDATE command message (type Command, uses AllowedMethods and/or SocketFile)
+//
+// Control mode talks to a running server's command socket:
+//  http-server ctl [--command-socket FILE] [--command-secret-file FILE] list
+//  http-server ctl [--command-socket FILE] [--command-secret-file FILE] inspect PATH
 //
 // When HTTP request arrives, server sends JSON message (type RequestMsg) on handler socket
 // External process replies with JSON message (type ResponseMsg)
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
 	"time"
-
+	"unicode/utf8"
+
+	auth "flows.local/http-server/auth"
+	compress "flows.local/http-server/compress"
+	config "flows.local/http-server/config"
+	expiry "flows.local/http-server/expiry"
+	peercred "flows.local/http-server/peercred"
+	registry "flows.local/http-server/registry"
+	route "flows.local/http-server/route"
 	sanitize "flows.local/http-server/sanitize"
+	signature "flows.local/http-server/signature"
+	spool "flows.local/http-server/spool"
+	tlsconfig "flows.local/http-server/tlsconfig"
 )
 
 // ---------------- Messages ----------------
@@ -46,31 +94,160 @@ type PingPong struct {
 }
 
 type Command struct {
-	Command           string   `json:"command"`
-	Path              string   `json:"path"`
-	SocketFile        string   `json:"socket_file"`
-	ExternalProcessID string   `json:"external_process_id"`
-	AllowedMethods    []string `json:"allowed_methods"`
-	Timeout           int      `json:"timeout"`
+	Command           string             `json:"command"`
+	Path              string             `json:"path"`
+	SocketFile        string             `json:"socket_file"`
+	ExternalProcessID string             `json:"external_process_id"`
+	AllowedMethods    []string           `json:"allowed_methods"`
+	Timeout           int                `json:"timeout"`
+	QueueDepth        int                `json:"queue_depth,omitempty"`        // Requests that may wait for the external process, 0 => no queue
+	QueueWait         int                `json:"queue_wait,omitempty"`         // In seconds, how long queued requests wait, 0 => timeout-read-external-process (with queue)
+	Mode              string             `json:"mode,omitempty"`               // single (default), multi or persistent
+	Shots             int                `json:"shots,omitempty"`              // Accepted requests before removal, multi mode only
+	Verify            *signature.Options `json:"verify,omitempty"`             // Request signature verification, optional
+	Auth              *auth.Options      `json:"auth,omitempty"`               // Request authentication, optional
+	GeneratePath      bool               `json:"generate_path,omitempty"`      // Server generates a random path under Path (prefix)
+	RequiredQuery     []string           `json:"required_query,omitempty"`     // Query string keys a request must have to match the path
+	ContentTypes      []string           `json:"content_types,omitempty"`      // Accepted request content types, default JSON and forms
+	MaxBodySize       int64              `json:"max_body_size,omitempty"`      // Bytes, request body size limit, 0 => server limit (also the maximum)
+	CompressResponse  bool               `json:"compress_response,omitempty"`  // Compress response body if the client accepts it
+	ResponseFile      bool               `json:"response_file,omitempty"`      // Server creates a file per request for the response body, unix sockets only
+	Protocol          string             `json:"protocol,omitempty"`           // Handler socket protocol, per-request (default) or persistent
+	MaxInFlight       int                `json:"max_in_flight,omitempty"`      // Requests relayed at once, persistent protocol and mode only
+	HeartbeatInterval int                `json:"heartbeat_interval,omitempty"` // In seconds, how often the owner sends heartbeats, 0 => none expected
+	Spool             bool               `json:"spool,omitempty"`              // Store requests while the external process is unreachable, server needs a spool directory
+	Secret            string             `json:"secret,omitempty"`             // Shared secret, mandatory if the server has one
+	peer              peercred.Cred      // Verified peer credentials, zero if not available
+	via               string             // Channel the command came on (command socket or control API)
 }
 
+// Command channels, owners change their resources on the channel they registered them
+const (
+	viaCommandSocket = "command-socket"
+	viaControlAPI    = "control-api"
+)
+
+// Handler modes
+const (
+	modeSingle     = "single"     // Removed after the first accepted request
+	modeMulti      = "multi"      // Removed after Shots accepted requests
+	modePersistent = "persistent" // Removed when deregistered (or on timeout, if set)
+)
+
+// Upper limit for the request queue of a resource, and for requests in flight
+const maxQueueDepth = 1024
+
+// Heartbeats an owner may miss before its resources are removed
+const missedHeartbeats = 3
+
+// Handler address prefix for TCP, socket files without it are unix sockets
+const tcpPrefix = "tcp://"
+
+// Handler socket protocols
+const (
+	protocolPerRequest = "per-request" // One connection per request, one request and one response message
+	protocolPersistent = "persistent"  // One connection per handler, messages matched by request ID
+)
+
 type RequestMsg struct {
-	Method      string              `json:"method"`
-	Path        string              `json:"path"`
-	Headers     map[string][]string `json:"headers"`
-	Body        any                 `json:"body,omitempty"`
-	ContentType string              `json:"content_type"`
-	Files       map[string]string   `json:"files,omitempty"`
-	Cookies     []*http.Cookie      `json:"cookies"`
-	InstanceUID string              `json:"instance_uid"` // Server instance unique identifier
+	RequestID    string              `json:"request_id"` // Unique per server instance, echoed in the response message
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	Route        string              `json:"route"`            // Registered path (template) that matched the request path
+	Params       map[string]string   `json:"params,omitempty"` // Path parameters matched by the route, wildcard is "*"
+	Query        map[string][]string `json:"query,omitempty"`  // Query string parameters
+	Headers      map[string][]string `json:"headers"`
+	Body         any                 `json:"body,omitempty"`
+	BodyEncoding string              `json:"body_encoding,omitempty"` // "base64" when Body is the raw (binary) body, TCP handlers only
+	ContentType  string              `json:"content_type"`
+	BodyFile     string              `json:"body_file,omitempty"` // Request body, when it's binary or too large for the message
+	Files        []FileInfo          `json:"files,omitempty"`
+	Cookies      []*http.Cookie      `json:"cookies"`
+	ClientCert   *ClientCert         `json:"client_cert,omitempty"`   // Verified client certificate (mutual TLS)
+	InstanceUID  string              `json:"instance_uid"`            // Server instance unique identifier
+	ResponseFile string              `json:"response_file,omitempty"` // Empty file for the response body (see ResponseMsg.BodyFile), removed with the request
+	inline       bool                // Body and uploaded files go in the message, never in files (TCP handlers)
+}
+
+// Files created for the external process
+func (req *RequestMsg) tempFiles() []string {
+	var files []string
+	if req.BodyFile != "" {
+		files = append(files, req.BodyFile)
+	}
+	for _, fi := range req.Files {
+		if fi.Path != "" {
+			files = append(files, fi.Path)
+		}
+	}
+	return files
+}
+
+// Point the message to the files moved elsewhere, in tempFiles() order
+func (req *RequestMsg) setTempFiles(files []string) {
+	if req.BodyFile != "" {
+		req.BodyFile, files = files[0], files[1:]
+	}
+	req.Files = slices.Clone(req.Files) // Caller's copy keeps the old paths
+	for i := range req.Files {
+		if req.Files[i].Path != "" {
+			req.Files[i].Path, files = files[0], files[1:]
+		}
+	}
+}
+
+// Uploaded form file, saved for the external process
+type FileInfo struct {
+	Field               string `json:"field"`                           // Form field name
+	Filename            string `json:"filename"`                        // Original file name, as sent by the client
+	ContentType         string `json:"content_type"`                    // Detected from the file content
+	DeclaredContentType string `json:"declared_content_type,omitempty"` // As sent by the client
+	Size                int64  `json:"size"`
+	Sha256              string `json:"sha256"`
+	Path                string `json:"path,omitempty"`    // Temporary file, external process owns (and removes) it
+	Content             []byte `json:"content,omitempty"` // File content (base64) instead of Path, TCP handlers only
+}
+
+type ClientCert struct {
+	Subject        string   `json:"subject"`
+	CommonName     string   `json:"common_name"`
+	Organization   []string `json:"organization,omitempty"`
+	Issuer         string   `json:"issuer"`
+	SerialNumber   string   `json:"serial_number"`
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	NotAfter       string   `json:"not_after"`
+	Fingerprint    string   `json:"fingerprint_sha256"`
+}
+
+// Sent to resource owners on their socket when the server drains, no reply expected
+type ShutdownMsg struct {
+	Event       string `json:"event"` // Always "shutdown"
+	Path        string `json:"path"`
+	Reason      string `json:"reason"`
+	Persisted   bool   `json:"persisted"` // Resource is kept in the registry, the next server instance restores it
+	InstanceUID string `json:"instance_uid"`
 }
 
 type ResponseMsg struct {
-	Ok          bool   `json:"ok"`           // External process signal, FALSE => respond with 400, TRUE => 200
-	Code        int    `json:"code"`         // Reserved for custom code
-	Status      string `json:"status"`       // Reserved for custom status message
-	Message     string `json:"message"`      // Reserved for custom message
-	InstanceUID string `json:"instance_uid"` // External process unique identifier
+	RequestID   string `json:"request_id,omitempty"` // Request message ID, mandatory with persistent protocol
+	Ok          bool   `json:"ok"`                   // External process signal, FALSE => respond with 400, TRUE => 202
+	Code        int    `json:"code"`                 // Reserved for custom code
+	Status      string `json:"status"`               // Reserved for custom status message
+	Message     string `json:"message"`              // Reserved for custom message
+	InstanceUID string `json:"instance_uid"`         // External process unique identifier
+	// Optional, when any of these is set the server writes them verbatim instead of this message
+	HttpStatus  int                 `json:"http_status,omitempty"`  // HTTP response status code, 0 => 202 or 400 (see Ok)
+	Headers     map[string][]string `json:"headers,omitempty"`      // HTTP response headers
+	ContentType string              `json:"content_type,omitempty"` // Response body content type, detected if not set
+	Body        any                 `json:"body,omitempty"`         // Strings are written as is, anything else is written as JSON
+	BodyFile    string              `json:"body_file,omitempty"`    // A file of the request (response file or request files) with the response body, removed after it's written
+}
+
+// External process wants to control the HTTP response
+func (rm *ResponseMsg) isCustom() bool {
+	return rm.HttpStatus != 0 || rm.Body != nil || rm.BodyFile != "" || len(rm.Headers) > 0 || rm.ContentType != ""
 }
 
 // ---------------- Handler Entry ----------------
@@ -78,16 +255,184 @@ type ResponseMsg struct {
 type HandlerEntry struct {
 	// Conn              net.Conn
 	Enabled           bool
-	Handling          bool         // external process is evaluating the request
-	Handled           bool         // external process has handled the request
-	SocketFile        string       // Socket to <-> from external PHP process
-	ExternalProcessID string       // PHP process unique identifier
-	AllowedMethods    []string     // Resource allowed HTTP methods
-	Timeout           int          // The resource is not valid (stale) if timeout <= 0
-	Handler           http.Handler // Request handler
+	Handling          bool               // external process is evaluating request(s)
+	Handled           bool               // external process has handled the request
+	SocketFile        string             // Socket to <-> from external PHP process
+	ExternalProcessID string             // PHP process unique identifier
+	AllowedMethods    []string           // Resource allowed HTTP methods
+	Route             *route.Pattern     // Registered path, static or template
+	RequiredQuery     []string           // Query string keys a request must have to match the route
+	ContentTypes      []string           // Accepted request content types
+	MaxBodySize       int64              // Bytes, request body size limit, 0 => server limit
+	CompressResponse  bool               // Compress response body if the client accepts it
+	ResponseFile      bool               // Server creates a file per request for the response body
+	Deadline          time.Time          // The resource expires at this time, zero => never
+	Lifetime          int                // Registered timeout in seconds, TOUCH sets the deadline this far from now, -1 => never
+	Mode              string             // How many accepted requests the resource serves
+	Shots             int                // Accepted requests left, multi mode only
+	QueueDepth        int                // How many requests may wait while the external process is evaluating another
+	QueueWait         int                // In seconds, how long a queued request waits for its turn
+	Queued            int                // Requests waiting or being evaluated
+	InFlight          int                // Requests being evaluated
+	MaxInFlight       int                // Requests the external process evaluates at once
+	turn              chan struct{}      // Limits requests to the external process, one slot per request in flight
+	conn              *handlerConn       // Persistent protocol connection, nil => one connection per request
+	HeartbeatInterval int                // In seconds, 0 => owner liveness not checked
+	LastSeen          time.Time          // Last heartbeat (or registration) from the owner
+	PeerPID           int32              // Verified pid of the registering process, 0 => not available
+	PeerUID           uint32             // Verified uid of the registering process
+	Via               string             // Channel the resource was registered on
+	Hits              int                // Requests that matched the resource
+	Relayed           int                // Requests relayed to the external process
+	Accepted          int                // Requests the external process accepted (ok)
+	Spool             bool               // Store requests while the external process is unreachable
+	Spooled           int                // Stored requests waiting for delivery
+	Verify            *signature.Options // Request signature verification, nil => none
+	Auth              *auth.Options      // Request authentication, nil => none
+	Handler           http.Handler       // Request handler
+	registered        Command            // Register command as accepted, written to the registry
 	mu                sync.Mutex
 }
 
+// Request body size limit
+func (e *HandlerEntry) bodyLimit() int64 {
+	if e.MaxBodySize > 0 {
+		return e.MaxBodySize
+	}
+	return maxBodySize
+}
+
+/* The deadline is absolute, relaying requests does not extend it. Requests in flight
+ * when it passes complete, but the resource takes no new requests and is removed once
+ * they are done. Owners that need more time RENEW or TOUCH the resource. */
+func (e *HandlerEntry) expired(now time.Time) bool {
+	return !e.Deadline.IsZero() && !now.Before(e.Deadline)
+}
+
+// Set the deadline timeout seconds from now, -1 => never expires
+func (e *HandlerEntry) expireIn(timeout int, now time.Time) {
+	if timeout < 0 {
+		e.Deadline = time.Time{}
+		return
+	}
+	e.Deadline = now.Add(time.Duration(timeout) * time.Second)
+}
+
+// When housekeeping must look at the resource again (deadline or missed heartbeats), zero => never
+func (e *HandlerEntry) nextCheck() time.Time {
+	at := e.Deadline
+	if e.HeartbeatInterval > 0 {
+		silent := e.LastSeen.Add(time.Duration(missedHeartbeats*e.HeartbeatInterval) * time.Second)
+		if at.IsZero() || silent.Before(at) {
+			at = silent
+		}
+	}
+	return at
+}
+
+/* Command comes from the resource owner: same ExternalProcessID, same channel as the
+ * register command and, when that one had verified peer credentials, a verified peer
+ * with the same uid (or root) */
+func (e *HandlerEntry) ownedBy(cmd Command) bool {
+	if e.ExternalProcessID != cmd.ExternalProcessID || e.Via != cmd.via {
+		return false
+	}
+	if e.PeerPID == 0 {
+		return true
+	}
+	return cmd.peer.PID != 0 && (cmd.peer.UID == 0 || cmd.peer.UID == e.PeerUID)
+}
+
+// Owner stopped sending heartbeats, it probably crashed
+func (e *HandlerEntry) ownerDead(now time.Time) bool {
+	if e.HeartbeatInterval <= 0 {
+		return false
+	}
+	return now.Sub(e.LastSeen) >= time.Duration(missedHeartbeats*e.HeartbeatInterval)*time.Second
+}
+
+/* Wait for the external process to be free to evaluate the request. Waiting requests
+ * are served in arrival order. */
+func (e *HandlerEntry) acquire(ctx context.Context) bool {
+	select {
+	case e.turn <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(time.Duration(e.QueueWait) * time.Second)
+	defer timer.Stop()
+	select {
+	case e.turn <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/* Request evaluation done, let the next queued request through. Removal of a used,
+ * expired or abandoned resource waits for requests in flight, schedule it now. */
+func (e *HandlerEntry) release() {
+	e.mu.Lock()
+	e.InFlight--
+	e.Handling = e.InFlight > 0
+	e.Queued--
+	done := !e.Handling && e.removal(time.Now()) != ""
+	e.mu.Unlock()
+	<-e.turn
+	if done {
+		expiries.Schedule(e.Route.String(), time.Now())
+	}
+}
+
+/* Resource removed: queued requests must not be relayed anymore and
+ * the persistent connection (if any) is closed */
+func (e *HandlerEntry) retire() {
+	e.mu.Lock()
+	e.Enabled = false
+	e.mu.Unlock()
+	if e.conn != nil {
+		e.conn.close()
+	}
+}
+
+// External process accepted a request, disable the resource if it has no more shots
+func (e *HandlerEntry) shoot() {
+	switch e.Mode {
+	case modePersistent:
+		return
+	case modeMulti:
+		e.Shots--
+		if e.Shots > 0 {
+			return
+		}
+	}
+	e.Enabled = false
+	e.Handled = true // ready for removal
+}
+
+// Response message received from the external process
+func (e *HandlerEntry) settle(key string, resp ResponseMsg) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !resp.Ok {
+		return
+	}
+
+	e.Accepted++
+	e.shoot()
+	if e.Auth != nil {
+		e.Auth.Revoke() // One time token
+	}
+	if !e.Enabled {
+		unpersist(key)
+	} else if e.Mode == modeMulti || (e.Auth != nil && e.Auth.Scheme == auth.OneTime) {
+		persist(key, e) // Shots left, revoked token
+	}
+}
+
 // ---------------- Logging ----------------
 
 type LogLine struct {
@@ -115,8 +460,86 @@ func NewMux() *DynamicMux {
 	return &DynamicMux{handlers: make(map[string]*HandlerEntry)}
 }
 
+// Request query string has all the keys the route requires
+func (e *HandlerEntry) matchQuery(query url.Values) bool {
+	for _, k := range e.RequiredQuery {
+		if !query.Has(k) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Find the handler entry for the request path and query. Static paths are looked up directly,
+ * otherwise the most specific path template that matches wins. */
+func (m *DynamicMux) match(path string, query url.Values) (string, *HandlerEntry, map[string]string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if e := m.handlers[path]; e != nil && e.Route.IsStatic() && e.matchQuery(query) {
+		return path, e, nil
+	}
+
+	var key string
+	var found *HandlerEntry
+	var params map[string]string
+	for k, e := range m.handlers {
+		if e.Route.IsStatic() {
+			continue
+		}
+		if (found != nil && !route.Less(e.Route, found.Route)) || !e.matchQuery(query) {
+			continue
+		}
+		if p, ok := e.Route.Match(path); ok {
+			key, found, params = k, e, p
+		}
+	}
+	return key, found, params
+}
+
 // ---------------- Handle requests ----------------
 
+// Strip invisible runes from query string keys and values
+func sanitizeQuery(query url.Values) map[string][]string {
+	if len(query) == 0 {
+		return nil
+	}
+
+	q := make(map[string][]string, len(query))
+	for key, values := range query {
+		key = sanitize.StripInvisibleRunes(key)
+		for _, v := range values {
+			q[key] = append(q[key], sanitize.StripInvisibleRunes(v))
+		}
+	}
+	return q
+}
+
+// Subject details of the client certificate verified during the TLS handshake, nil if none
+func clientCertOf(r *http.Request) *ClientCert {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	c := r.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(c.Raw)
+	cc := &ClientCert{
+		Subject:        c.Subject.String(),
+		CommonName:     c.Subject.CommonName,
+		Organization:   c.Subject.Organization,
+		Issuer:         c.Issuer.String(),
+		SerialNumber:   c.SerialNumber.String(),
+		DNSNames:       c.DNSNames,
+		EmailAddresses: c.EmailAddresses,
+		NotAfter:       c.NotAfter.UTC().Format(time.RFC3339),
+		Fingerprint:    hex.EncodeToString(sum[:]),
+	}
+	for _, u := range c.URIs {
+		cc.URIs = append(cc.URIs, u.String())
+	}
+	return cc
+}
+
 /* Creates a file in the os temporary directory that is meant to be used by the external process that's
  * handling the HTTP request content. */
 func createFileForExtProc() (*os.File, error) {
@@ -131,7 +554,7 @@ func createFileForExtProc() (*os.File, error) {
 /* Clean up in case of errors before sending message to external process.
  * Delete files in the os temporary directory that is meant to be used by the external process that's
  * handling the HTTP request content. */
-func deleteFilesForExtProc(files map[string]string, e *HandlerEntry) {
+func deleteFilesForExtProc(files []string, e *HandlerEntry) {
 	for _, filePath := range files {
 		_, err := os.Stat(filePath)
 		if err != nil {
@@ -149,8 +572,65 @@ func deleteFilesForExtProc(files map[string]string, e *HandlerEntry) {
 	}
 }
 
+/* Copy uploaded form file content to a file for the external process (or to the message,
+ * inline), detecting its content type and computing size and checksum along the way. */
+func saveFormFile(field string, fh *multipart.FileHeader, inline bool) (FileInfo, error) {
+	fi := FileInfo{
+		Field:               sanitize.StripInvisibleRunes(field),
+		Filename:            sanitize.StripInvisibleRunes(fh.Filename),
+		DeclaredContentType: sanitize.StripInvisibleRunes(fh.Header.Get("Content-Type")),
+	}
+	file, err := fh.Open()
+	if err != nil {
+		return fi, err
+	}
+	defer file.Close()
+
+	var content bytes.Buffer
+	var dst io.Writer = &content
+	if !inline {
+		fileForExtProc, err := createFileForExtProc()
+		if err != nil {
+			return fi, err
+		}
+		defer fileForExtProc.Close()
+		fi.Path = fileForExtProc.Name()
+		dst = fileForExtProc
+	}
+
+	// Content type detection uses at most the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fi, err
+	}
+	fi.ContentType = http.DetectContentType(head[:n])
+
+	hash := sha256.New()
+	w := io.MultiWriter(dst, hash)
+	if _, err := w.Write(head[:n]); err != nil {
+		return fi, err
+	}
+	rest, err := io.Copy(w, file)
+	if err != nil {
+		return fi, err
+	}
+	fi.Size = int64(n) + rest
+	fi.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	if inline {
+		fi.Content = content.Bytes()
+	}
+	return fi, nil
+}
+
+// GET and DELETE requests are relayed without body
+func hasBody(r *http.Request) bool {
+	return !slices.Contains([]string{http.MethodDelete, http.MethodGet}, r.Method)
+}
+
 func handleWithoutBody(req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
 	req.Body = nil
+	req.BodyFile = ""
 	req.Files = nil
 	return ResponseMsg{
 		Ok:          true,
@@ -160,156 +640,26 @@ func handleWithoutBody(req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
 		InstanceUID: e.ExternalProcessID}, nil
 }
 
-func handleWithBody(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
-	rmSize := ResponseMsg{
-		Ok:          false,
-		Code:        400,
-		Status:      "fail",
-		Message:     "Request max size is 16 MB",
-		InstanceUID: e.ExternalProcessID}
-
-	switch req.ContentType {
-	case "application/json":
-		// Read raw body
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			return rmSize, errors.New(rmSize.Message)
-		}
-		// Sanitize raw body
-		body = sanitize.StripInvisibleBytes(body)
-		// Parse JSON body
-		if !json.Valid(body) {
-			rm := ResponseMsg{
-				Ok:          false,
-				Code:        400,
-				Status:      "fail",
-				Message:     "Invalid JSON",
-				InstanceUID: e.ExternalProcessID}
-			return rm, errors.New(rm.Message)
-		}
-		// Set message body
-		req.Body = string(body)
-		return ResponseMsg{
-			Ok:          true,
-			Code:        0,
-			Status:      "success",
-			Message:     "Set message body",
-			InstanceUID: e.ExternalProcessID}, nil
-
-	case "application/x-www-form-urlencoded":
-		err := r.ParseForm()
-		if err != nil {
-			return rmSize, errors.New(rmSize.Message)
-		}
-		if r.Form != nil && req.Body == nil {
-			/* Only concrete types (e.g., map[string]string) support indexing.
-			 * Fix by doing a type assertion (or switching on the type) and ensuring message.Body
-			 * is a map before writing into it. */
-			mb := make(map[string]string)
-			for key, values := range r.Form {
-				if len(values) > 0 {
-					mb[key] = sanitize.StripInvisibleRunes(values[0])
-				}
-			}
-			if len(mb) > 0 {
-				req.Body = mb
-			} else {
-				req.Body = []any{}
-			}
-		}
-
-		return ResponseMsg{
-			Ok:          true,
-			Code:        0,
-			Status:      "success",
-			Message:     "Set message body",
-			InstanceUID: e.ExternalProcessID}, nil
+// Form values, all of them for each key
+func formValues(form map[string][]string) any {
+	if len(form) == 0 {
+		return []any{}
+	}
 
-	case "multipart/form-data":
-		err := r.ParseMultipartForm(maxBodySize)
-		if err != nil {
-			return rmSize, errors.New(rmSize.Message)
-		}
-		if r.MultipartForm != nil && r.MultipartForm.Value != nil {
-			mb := make(map[string]string)
-			for key, values := range r.MultipartForm.Value {
-				if len(values) > 0 {
-					mb[key] = sanitize.StripInvisibleRunes(values[0])
-				}
-			}
-			if len(mb) > 0 {
-				req.Body = mb
-			} else {
-				req.Body = []any{}
-			}
-		}
-		if r.MultipartForm != nil && r.MultipartForm.File != nil {
-			req.Files = make(map[string]string)
-			for _, fhs := range r.MultipartForm.File {
-				for _, fh := range fhs {
-					file, err := fh.Open()
-					if err != nil {
-						rm := ResponseMsg{
-							Ok:          false,
-							Code:        400,
-							Status:      "fail",
-							Message:     "Failed to open file " + fh.Filename,
-							InstanceUID: e.ExternalProcessID}
-						return rm, errors.New(rm.Message)
-					}
-					// Create file for external process with uploaded form file content
-					fileForExtProc, err := createFileForExtProc()
-					if err != nil {
-						file.Close()
-						// Delete previously created files
-						defer deleteFilesForExtProc(req.Files, e)
-
-						rm := ResponseMsg{
-							Ok:          false,
-							Code:        400,
-							Status:      "fail",
-							Message:     "Failed to create file for external process",
-							InstanceUID: e.ExternalProcessID}
-						return rm, errors.New(rm.Message)
-					}
-					// Copy file for external process use
-					_, err = io.Copy(fileForExtProc, file)
-					fileForExtProc.Close()
-					file.Close()
-					if err != nil {
-						// Delete previously created files
-						req.Files[sanitize.StripInvisibleRunes(fh.Filename)] = fileForExtProc.Name()
-						defer deleteFilesForExtProc(req.Files, e)
-
-						rm := ResponseMsg{
-							Ok:          false,
-							Code:        400,
-							Status:      "fail",
-							Message:     "Failed to save file " + fh.Filename,
-							InstanceUID: e.ExternalProcessID}
-						return rm, errors.New(rm.Message)
-					}
-					// Add to message
-					req.Files[sanitize.StripInvisibleRunes(fh.Filename)] = fileForExtProc.Name()
-				}
-			}
-			// Remove temporary files
-			r.MultipartForm.RemoveAll()
+	mb := make(map[string][]string, len(form))
+	for key, values := range form {
+		key = sanitize.StripInvisibleRunes(key)
+		for _, v := range values {
+			mb[key] = append(mb[key], sanitize.StripInvisibleRunes(v))
 		}
 	}
-	return ResponseMsg{
-		Ok:          true,
-		Code:        0,
-		Status:      "success",
-		Message:     "Set message body and/or files",
-		InstanceUID: e.ExternalProcessID}, nil
+	return mb
 }
 
 func (m *DynamicMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	m.mu.RLock()
-	e := m.handlers[r.URL.Path]
-	m.mu.RUnlock()
-
+	// Malformed pairs are dropped
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	key, e, params := m.match(r.URL.Path, query)
 	if e == nil {
 		http.NotFound(w, r)
 		return
@@ -318,15 +668,19 @@ func (m *DynamicMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	active.Add(1)
+	defer active.Add(-1)
+	if draining.Load() {
+		shuttingDown(w)
+		return
+	}
+
 	e.mu.Lock()
-	if !e.Enabled {
+	e.Hits++
+	if !e.Enabled || e.expired(time.Now()) {
 		http.NotFound(w, r)
 		e.mu.Unlock()
 		return
-	} else if e.Handling {
-		w.WriteHeader(http.StatusLocked)
-		e.mu.Unlock()
-		return
 	} else if !slices.Contains(e.AllowedMethods, r.Method) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		e.mu.Unlock()
@@ -343,44 +697,139 @@ func (m *DynamicMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					e.mu.Unlock()
 					return
 				}
-				if mt == "application/json" || mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data" {
+				if slices.Contains(e.ContentTypes, mt) {
 					canServe = true
 					break
 				}
 			}
 		}
 		if !canServe {
-			w.Header().Set("Accept", "application/json, application/x-www-form-urlencoded, multipart/form-data")
+			w.Header().Set("Accept", strings.Join(e.ContentTypes, ", "))
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			e.mu.Unlock()
+			return
+		}
+	}
+	if hasBody(r) {
+		ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			e.mu.Unlock()
+			return
+		} else if !slices.Contains(e.ContentTypes, ct) {
+			w.Header().Set("Accept", strings.Join(e.ContentTypes, ", "))
 			w.WriteHeader(http.StatusUnsupportedMediaType)
 			e.mu.Unlock()
 			return
 		}
 	}
 
+	verify := e.Verify
+	authOpts := e.Auth
+	e.mu.Unlock()
+	// Unauthorized and forged requests must not reach (or wait for) the external process
+	if authOpts != nil && !authenticate(w, r, e, authOpts) {
+		return
+	}
+	// authenticate() revoked the one time token, it's given back unless the request is accepted
+	tokenUsed := false
+	if authOpts != nil && authOpts.Scheme == auth.OneTime {
+		defer func() {
+			if !tokenUsed {
+				authOpts.Restore()
+			}
+		}()
+	}
+	// Senders sign the body as sent, compressed or not
+	if verify != nil && !verifySignature(w, r, e, verify) {
+		return
+	}
+	if hasBody(r) && !decompressBody(w, r, e) {
+		return
+	}
+
+	e.mu.Lock()
+	if e.Queued >= e.QueueDepth+e.MaxInFlight {
+		// Request queue is full
+		e.mu.Unlock()
+		retryLater(w, e)
+		return
+	}
+
+	e.Queued++
+	e.mu.Unlock()
+
+	if !e.acquire(r.Context()) {
+		// Waited too long for the external process
+		e.mu.Lock()
+		e.Queued--
+		e.mu.Unlock()
+		retryLater(w, e)
+		return
+	}
+	// In flight from here, release() counts it down even if it's not relayed
+	e.mu.Lock()
+	e.InFlight++
 	e.Handling = true
 	e.mu.Unlock()
+	defer e.release()
+	if draining.Load() {
+		// Queued before the drain started, not relayed
+		shuttingDown(w)
+		return
+	}
+
+	e.mu.Lock()
+	if !e.Enabled || e.expired(time.Now()) {
+		// Previous request in the queue used the last shot, or the deadline passed
+		http.NotFound(w, r)
+		e.mu.Unlock()
+		return
+	}
+
+	e.Relayed++
+	socketFile, hc := e.SocketFile, e.conn // UPDATE may change them
+	responseFile := e.ResponseFile
+	e.mu.Unlock()
 
+	for k, v := range params {
+		params[k] = sanitize.StripInvisibleRunes(v)
+	}
 	req := RequestMsg{
+		RequestID:   strconv.FormatUint(requestCounter.Add(1), 10),
 		Method:      r.Method,
 		Path:        r.URL.Path,
+		Route:       key,
+		Params:      params,
+		Query:       sanitizeQuery(query),
 		Headers:     r.Header,
 		Cookies:     r.Cookies(),
+		ClientCert:  clientCertOf(r),
 		InstanceUID: serverUID,
+		inline:      strings.HasPrefix(socketFile, tcpPrefix),
+	}
+	if responseFile && !req.inline {
+		f, err := os.CreateTemp(os.TempDir(), "flows-http-response-file-")
+		if err != nil {
+			logThis(LogLine{"create:file", "fail", err.Error(), r.URL.Path, serverUID, e.ExternalProcessID})
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.Close()
+		req.ResponseFile = f.Name()
+		defer os.Remove(req.ResponseFile) // Unless it was sent as body file
 	}
 
 	var handleResp ResponseMsg
 	var err error
-	if slices.Contains([]string{http.MethodDelete, http.MethodGet}, r.Method) {
+	if !hasBody(r) {
 		handleResp, err = handleWithoutBody(&req, e)
 	} else {
-		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		r.Body = http.MaxBytesReader(w, r.Body, e.bodyLimit())
 		var ct string
 		ct, _, err = mime.ParseMediaType(r.Header.Get("Content-Type"))
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			e.mu.Lock()
-			e.Handling = false
-			e.mu.Unlock()
 			return
 		}
 
@@ -388,298 +837,2179 @@ func (m *DynamicMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		handleResp, err = handleWithBody(r, &req, e)
 	}
 	if err != nil {
+		status := http.StatusBadRequest
+		if handleResp.Code == http.StatusRequestEntityTooLarge {
+			status = handleResp.Code
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(status)
 		jm, _ := json.Marshal(handleResp)
 		w.Write(jm)
-		e.mu.Lock()
-		e.Handling = false
-		e.mu.Unlock()
 		return
 	}
 
-	conn, err := net.Dial("unix", e.SocketFile)
-	if err != nil {
+	resp, err := relay(socketFile, hc, req)
+	if errors.Is(err, errSocketDial) && spoolRequest(key, e, req, err) {
+		tokenUsed = true
+		queued := ResponseMsg{RequestID: req.RequestID, Ok: true, Code: http.StatusAccepted, Status: "queued", Message: "stored for delivery"}
+		writeResponse(w, r, queued, e, nil)
+		return
+	} else if errors.Is(err, errSocketDial) {
+		deleteFilesForExtProc(req.tempFiles(), e)
 		w.WriteHeader(http.StatusBadRequest)
-		e.mu.Lock()
-		e.Handling = false
-		e.mu.Unlock()
 		return
-	}
-
-	duration := time.Duration(timeoutReadExtProc) * time.Second
-	conn.SetReadDeadline(time.Now().Add(duration))
-	defer conn.Close()
-
-	enc := json.NewEncoder(conn)
-	dec := json.NewDecoder(conn)
-
-	if err := enc.Encode(req); err != nil {
-		defer deleteFilesForExtProc(req.Files, e)
-		logThis(LogLine{"socket:write", "fail", err.Error(), e.SocketFile, serverUID, e.ExternalProcessID})
+	} else if errors.Is(err, errSocketWrite) {
+		defer deleteFilesForExtProc(req.tempFiles(), e)
+		logThis(LogLine{"socket:write", "fail", err.Error(), socketFile, serverUID, e.ExternalProcessID})
 		w.WriteHeader(http.StatusInternalServerError)
-		e.mu.Lock()
-		e.Handling = false
-		e.mu.Unlock()
 		return
-	}
-
-	var resp ResponseMsg
-	if err := dec.Decode(&resp); err != nil && err != io.EOF {
+	} else if err != nil {
 		/* Don't call deleteFilesForExtProc() here because the
 		 * external process might still be using these files */
-		logThis(LogLine{"socket:read", "fail", err.Error(), e.SocketFile, serverUID, e.ExternalProcessID})
+		logThis(LogLine{"socket:read", "fail", err.Error(), socketFile, serverUID, e.ExternalProcessID})
 		w.WriteHeader(http.StatusInternalServerError)
-		e.mu.Lock()
-		e.Handling = false
-		e.mu.Unlock()
 		return
 	}
 
-	e.mu.Lock()
-	e.Handling = false
-	w.Header().Set("Content-Type", "application/json")
-	if resp.Ok {
-		e.Enabled = false // single shot
-		e.Handled = true  // ready for removal
-		w.WriteHeader(http.StatusAccepted)
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
-	}
-
-	jm, _ := json.Marshal(resp)
-	w.Write(jm)
-	e.mu.Unlock()
+	e.settle(key, resp)
+	tokenUsed = resp.Ok
+	writeResponse(w, r, resp, e, append(req.tempFiles(), req.ResponseFile))
 }
 
-// ---------------- Command Socket ----------------
-
-type CommandReply struct {
-	Ok    bool   `json:"ok"`
-	Error string `json:"error,omitempty"`
+// Check the request credentials, responds with 401 if they are not valid
+func authenticate(w http.ResponseWriter, r *http.Request, e *HandlerEntry, authOpts *auth.Options) bool {
+	if err := auth.Check(authOpts, r); err != nil {
+		logThis(LogLine{"auth:check", "fail", err.Error(), r.URL.Path, serverUID, e.ExternalProcessID})
+		if challenge := authOpts.Challenge(); challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
 }
 
-func register(cmd Command, mux *DynamicMux) CommandReply {
-	if slices.Contains(cmd.AllowedMethods, http.MethodConnect) || slices.Contains(cmd.AllowedMethods, http.MethodHead) || slices.Contains(cmd.AllowedMethods, http.MethodOptions) || slices.Contains(cmd.AllowedMethods, http.MethodTrace) {
-		return CommandReply{Ok: false, Error: "invalid method"}
+/* Decode the request body according to its Content-Encoding. Both compressed and decompressed
+ * sizes are limited by the resource body size limit (zip bomb protection). */
+func decompressBody(w http.ResponseWriter, r *http.Request, e *HandlerEntry) bool {
+	ce := r.Header.Get("Content-Encoding")
+	if ce == "" {
+		return true
 	}
 
-	cmd.Path = strings.TrimSpace(cmd.Path)
-	cmd.Path = sanitize.StripInvisibleRunes(cmd.Path)
+	body, err := compress.NewReader(ce, http.MaxBytesReader(w, r.Body, e.bodyLimit()))
+	if errors.Is(err, compress.ErrUnsupported) {
+		w.Header().Set("Accept-Encoding", "gzip, deflate, br")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return false
+	} else if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, io.NopCloser(body), e.bodyLimit())
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return true
+}
+
+/* Check the request signature against the raw body, which is kept for the external process.
+ * Responds with 401 if the signature is not valid. */
+func verifySignature(w http.ResponseWriter, r *http.Request, e *HandlerEntry, verify *signature.Options) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, e.bodyLimit())
+	head, err := io.ReadAll(io.LimitReader(r.Body, spillThreshold+1))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	var body io.ReadSeeker = bytes.NewReader(head)
+	if int64(len(head)) > spillThreshold {
+		// Large body is kept on disk until the request is done
+		f, err := os.CreateTemp(os.TempDir(), "flows-http-request-raw-")
+		if err != nil {
+			logThis(LogLine{"create:file", "fail", err.Error(), r.URL.Path, serverUID, e.ExternalProcessID})
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		context.AfterFunc(r.Context(), func() {
+			f.Close()
+			os.Remove(f.Name())
+		})
+		if _, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), r.Body)); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return false
+		}
+		body = f
+	}
+
+	body.Seek(0, io.SeekStart)
+	if err := signature.Verify(verify, r.Header, body, time.Now()); err != nil {
+		logThis(LogLine{"signature:verify", "fail", err.Error(), r.URL.Path, serverUID, e.ExternalProcessID})
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	body.Seek(0, io.SeekStart)
+	r.Body = io.NopCloser(body)
+	return true
+}
+
+/* The resource is busy and the request could not be queued, or waited too long.
+ * Client should retry later. */
+func retryLater(w http.ResponseWriter, e *HandlerEntry) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, e.QueueWait)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// Server is draining, client should retry on another (or restarted) server
+func shuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// ---------------- Handler connections ----------------
+
+var requestCounter atomic.Uint64
+
+var (
+	errSocketDial  = errors.New("socket dial")
+	errSocketWrite = errors.New("socket write")
+	errSocketRead  = errors.New("socket read")
+)
+
+/* Network and address of the external process socket. TCP handlers may not share the
+ * server's filesystem: their request bodies and uploaded files are sent in the message
+ * (see RequestMsg.inline), never spilled to files. */
+func handlerNetwork(socketFile string) (string, string) {
+	if addr, ok := strings.CutPrefix(socketFile, tcpPrefix); ok {
+		return "tcp", addr
+	}
+	return "unix", socketFile
+}
+
+func validSocketFile(socketFile string) bool {
+	network, addr := handlerNetwork(socketFile)
+	if network == "tcp" {
+		_, port, err := net.SplitHostPort(addr)
+		return err == nil && port != ""
+	}
+	return addr != ""
+}
+
+/* Send the request message to the external process and wait for its response message,
+ * over the persistent connection hc (if not nil) or a new connection to socketFile */
+func relay(socketFile string, hc *handlerConn, req RequestMsg) (ResponseMsg, error) {
+	timeout := time.Duration(timeoutReadExtProc) * time.Second
+	if hc != nil {
+		return hc.roundTrip(req, timeout)
+	}
+
+	var resp ResponseMsg
+	network, addr := handlerNetwork(socketFile)
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return resp, fmt.Errorf("%w: %v", errSocketDial, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, fmt.Errorf("%w: %v", errSocketWrite, err)
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil && err != io.EOF {
+		return resp, fmt.Errorf("%w: %v", errSocketRead, err)
+	}
+	return resp, nil
+}
+
+/* Persistent connection to the external process: request messages are written as they come,
+ * response messages are read as they come (in any order) and matched by request ID.
+ * The connection is dialed on first use and again after it fails. */
+type handlerConn struct {
+	socketFile string
+	mu         sync.Mutex
+	conn       net.Conn
+	enc        *json.Encoder
+	pending    map[string]chan ResponseMsg // Request ID => response message
+	closed     bool
+}
+
+func newHandlerConn(socketFile string) *handlerConn {
+	return &handlerConn{socketFile: socketFile, pending: make(map[string]chan ResponseMsg)}
+}
+
+func (c *handlerConn) roundTrip(req RequestMsg, timeout time.Duration) (ResponseMsg, error) {
+	ch := make(chan ResponseMsg, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ResponseMsg{}, fmt.Errorf("%w: connection closed", errSocketDial)
+	}
+	if c.conn == nil {
+		network, addr := handlerNetwork(c.socketFile)
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			c.mu.Unlock()
+			return ResponseMsg{}, fmt.Errorf("%w: %v", errSocketDial, err)
+		}
+		c.conn = conn
+		c.enc = json.NewEncoder(conn)
+		go c.read(conn)
+	}
+
+	conn := c.conn
+	c.pending[req.RequestID] = ch
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := c.enc.Encode(req); err != nil {
+		delete(c.pending, req.RequestID)
+		c.reset(conn)
+		c.mu.Unlock()
+		return ResponseMsg{}, fmt.Errorf("%w: %v", errSocketWrite, err)
+	}
+	c.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return resp, fmt.Errorf("%w: connection lost", errSocketRead)
+		}
+		return resp, nil
+
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, req.RequestID)
+		c.mu.Unlock()
+		return ResponseMsg{}, fmt.Errorf("%w: timeout", errSocketRead)
+	}
+}
+
+// Dispatch response messages to the requests waiting for them
+func (c *handlerConn) read(conn net.Conn) {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var resp ResponseMsg
+		if err := dec.Decode(&resp); err != nil {
+			c.mu.Lock()
+			c.reset(conn)
+			c.mu.Unlock()
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.RequestID]
+		delete(c.pending, resp.RequestID)
+		c.mu.Unlock()
+		if !ok {
+			// Request timed out or unknown request ID
+			logThis(LogLine{"socket:read", "fail", "no request for response " + resp.RequestID, c.socketFile, serverUID, resp.InstanceUID})
+			continue
+		}
+		ch <- resp
+	}
+}
+
+// Close the connection and fail its requests, caller holds c.mu
+func (c *handlerConn) reset(conn net.Conn) {
+	if c.conn != conn {
+		return // Already reset
+	}
+
+	conn.Close()
+	c.conn = nil
+	c.enc = nil
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// Write a message without expecting a reply, on the connection if there is one
+func (c *handlerConn) notify(msg any, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errors.New("not connected")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	return c.enc.Encode(msg)
+}
+
+func (c *handlerConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.reset(c.conn)
+	}
+}
+
+// ---------------- Body decoders ----------------
+
+// Sets the message body (or body file) from the request body
+type bodyDecoder func(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error)
+
+var bodyDecoders = map[string]bodyDecoder{
+	"application/json":                  decodeJSON,
+	"application/x-www-form-urlencoded": decodeForm,
+	"multipart/form-data":               decodeMultipart,
+	"text/plain":                        decodeText,
+	"application/xml":                   decodeXML,
+	"text/xml":                          decodeXML, // SOAP 1.1
+	"application/octet-stream":          decodeBinary,
+	"application/x-ndjson":              decodeNDJSON,
+	"application/ndjson":                decodeNDJSON,
+}
+
+// Resources accept these request content types unless others are set on register
+var defaultContentTypes = []string{"application/json", "application/x-www-form-urlencoded", "multipart/form-data"}
+
+// Decoder for the media type, structured syntax suffixes (+json, +xml) included
+func decoderFor(ct string) bodyDecoder {
+	if d, ok := bodyDecoders[ct]; ok {
+		return d
+	}
+
+	switch {
+	case strings.HasSuffix(ct, "+json"):
+		return decodeJSON
+	case strings.HasSuffix(ct, "+xml"):
+		return decodeXML // SOAP 1.2 (application/soap+xml), Atom, ...
+	}
+	return nil
+}
+
+func decodeOk(e *HandlerEntry, message string) (ResponseMsg, error) {
+	return ResponseMsg{
+		Ok:          true,
+		Code:        0,
+		Status:      "success",
+		Message:     message,
+		InstanceUID: e.ExternalProcessID}, nil
+}
+
+func decodeFail(e *HandlerEntry, message string) (ResponseMsg, error) {
+	rm := ResponseMsg{
+		Ok:          false,
+		Code:        400,
+		Status:      "fail",
+		Message:     message,
+		InstanceUID: e.ExternalProcessID}
+	return rm, errors.New(rm.Message)
+}
+
+// Body over the resource limit, answered with 413
+func sizeExceeded(e *HandlerEntry) (ResponseMsg, error) {
+	limit := e.bodyLimit()
+	size := strconv.FormatInt(limit, 10) + " bytes"
+	if limit >= 1<<20 && limit%(1<<20) == 0 {
+		size = strconv.FormatInt(limit>>20, 10) + " MB"
+	}
+	rm, err := decodeFail(e, "Request max size is "+size)
+	rm.Code = http.StatusRequestEntityTooLarge
+	return rm, err
+}
+
+// Form parsing failure, the body is too large or malformed
+func formError(e *HandlerEntry, err error) (ResponseMsg, error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return sizeExceeded(e)
+	}
+	return decodeFail(e, "Invalid form")
+}
+
+/* Body read failure: too large, not valid for its content encoding or
+ * the file for the external process could not be written */
+func bodyError(e *HandlerEntry, err error) (ResponseMsg, error) {
+	var maxErr *http.MaxBytesError
+	var compressErr *compress.Error
+	if errors.As(err, &maxErr) {
+		return sizeExceeded(e)
+	} else if errors.As(err, &compressErr) {
+		return decodeFail(e, "Invalid content encoding")
+	}
+	return decodeFail(e, "Failed to create file for external process")
+}
+
+// How the body content is sanitized
+const (
+	sanitizeNone  = iota
+	sanitizeBytes // Strip invisible runes
+	sanitizeText  // Strip invisible runes, except tabs and line breaks
+)
+
+/* Read the request body: bodies up to spillThreshold bytes are returned, larger ones are
+ * streamed to a file for the external process (req.BodyFile), in which case nil is returned.
+ * Inline bodies are always returned, the body size limit caps them. */
+func readBody(r *http.Request, req *RequestMsg, mode int) ([]byte, error) {
+	threshold := spillThreshold
+	if req.inline {
+		threshold = math.MaxInt64 - 1
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, threshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) <= threshold {
+		switch mode {
+		case sanitizeBytes:
+			head = sanitize.StripInvisibleBytes(head)
+		case sanitizeText:
+			head = sanitize.StripInvisibleText(head)
+		}
+		return head, nil
+	}
+
+	var src io.Reader = io.MultiReader(bytes.NewReader(head), r.Body)
+	if mode != sanitizeNone {
+		src = sanitize.NewReader(src, mode == sanitizeText)
+	}
+	return nil, spillBody(req, src)
+}
+
+// Write body content to a file for the external process
+func spillBody(req *RequestMsg, body io.Reader) error {
+	f, err := createFileForExtProc()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	req.BodyFile = f.Name()
+	return nil
+}
+
+/* Check the body file content with valid(), on failure the file is removed.
+ * Used for bodies too large to check in memory. */
+func validBodyFile(req *RequestMsg, e *HandlerEntry, valid func(io.Reader) bool) bool {
+	f, err := os.Open(req.BodyFile)
+	if err == nil {
+		ok := valid(bufio.NewReader(f))
+		f.Close()
+		if ok {
+			return true
+		}
+	}
+	deleteFilesForExtProc([]string{req.BodyFile}, e)
+	req.BodyFile = ""
+	return false
+}
+
+// Exactly one JSON value, checked token by token
+func validJSON(rd io.Reader) bool {
+	dec := json.NewDecoder(rd)
+	depth := 0
+	seen := false
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return seen && depth == 0
+		} else if err != nil || (seen && depth == 0) {
+			return false
+		}
+
+		if d, ok := t.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			seen = true
+		}
+	}
+}
+
+// Well-formed XML document
+func validXML(rd io.Reader) bool {
+	dec := xml.NewDecoder(rd)
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			return false
+		}
+	}
+}
+
+func validUTF8(rd io.Reader) bool {
+	br := bufio.NewReader(rd)
+	for {
+		r, size, err := br.ReadRune()
+		if err == io.EOF {
+			return true
+		} else if err != nil || (r == utf8.RuneError && size == 1) {
+			return false
+		}
+	}
+}
+
+func handleWithBody(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	decode := decoderFor(req.ContentType)
+	if decode == nil {
+		return decodeFail(e, "Unsupported content type")
+	}
+	return decode(r, req, e)
+}
+
+func decodeJSON(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	// Read and sanitize raw body
+	body, err := readBody(r, req, sanitizeBytes)
+	if err != nil {
+		return bodyError(e, err)
+	}
+	if req.BodyFile != "" {
+		if !validBodyFile(req, e, validJSON) {
+			return decodeFail(e, "Invalid JSON")
+		}
+		return decodeOk(e, "Set message body file")
+	}
+	// Parse JSON body
+	if !json.Valid(body) {
+		return decodeFail(e, "Invalid JSON")
+	}
+	// Set message body
+	req.Body = string(body)
+	return decodeOk(e, "Set message body")
+}
+
+func decodeForm(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return formError(e, err)
+	}
+	if r.Form != nil && req.Body == nil {
+		// Body only, query string parameters are in the message query
+		req.Body = formValues(r.PostForm)
+	}
+	return decodeOk(e, "Set message body")
+}
+
+func decodeMultipart(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	// Files beyond spillThreshold bytes are kept on disk while parsing (server side only)
+	err := r.ParseMultipartForm(spillThreshold)
+	if err != nil {
+		return formError(e, err)
+	}
+	if r.MultipartForm != nil && r.MultipartForm.Value != nil {
+		req.Body = formValues(r.MultipartForm.Value)
+	}
+	if r.MultipartForm != nil && r.MultipartForm.File != nil {
+		// Remove temporary files
+		defer r.MultipartForm.RemoveAll()
+		fields := make([]string, 0, len(r.MultipartForm.File))
+		for field := range r.MultipartForm.File {
+			fields = append(fields, field)
+		}
+		slices.Sort(fields)
+
+		for _, field := range fields {
+			for _, fh := range r.MultipartForm.File[field] {
+				fi, err := saveFormFile(field, fh, req.inline)
+				if fi.Path != "" || (req.inline && err == nil) {
+					req.Files = append(req.Files, fi)
+				}
+				if err != nil {
+					// Delete previously created files
+					deleteFilesForExtProc(req.tempFiles(), e)
+					req.Files = nil
+					return decodeFail(e, "Failed to save file "+fh.Filename)
+				}
+			}
+		}
+	}
+	return decodeOk(e, "Set message body and/or files")
+}
+
+func decodeText(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	body, err := readBody(r, req, sanitizeText)
+	if err != nil {
+		return bodyError(e, err)
+	}
+	if req.BodyFile != "" {
+		if !validBodyFile(req, e, validUTF8) {
+			return decodeFail(e, "Invalid UTF-8 text")
+		}
+		return decodeOk(e, "Set message body file")
+	}
+	if !utf8.Valid(body) {
+		return decodeFail(e, "Invalid UTF-8 text")
+	}
+	req.Body = string(body)
+	return decodeOk(e, "Set message body")
+}
+
+func decodeXML(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	body, err := readBody(r, req, sanitizeText)
+	if err != nil {
+		return bodyError(e, err)
+	}
+	if req.BodyFile != "" {
+		if !validBodyFile(req, e, validXML) {
+			return decodeFail(e, "Invalid XML")
+		}
+		return decodeOk(e, "Set message body file")
+	}
+	if !validXML(bytes.NewReader(body)) {
+		return decodeFail(e, "Invalid XML")
+	}
+	req.Body = string(body)
+	return decodeOk(e, "Set message body")
+}
+
+// Raw body, always written to a file for the external process (base64 in the message, inline)
+func decodeBinary(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	if req.inline {
+		body, err := readBody(r, req, sanitizeNone)
+		if err != nil {
+			return bodyError(e, err)
+		}
+		req.Body = body
+		req.BodyEncoding = "base64"
+		return decodeOk(e, "Set message body")
+	}
+	if err := spillBody(req, r.Body); err != nil {
+		return bodyError(e, err)
+	}
+	return decodeOk(e, "Set message body file")
+}
+
+/* Newline delimited JSON, message body is the list of records (JSON strings). Once the
+ * records exceed spillThreshold bytes they are written to a file instead, one per line
+ * (unless inline). */
+func decodeNDJSON(r *http.Request, req *RequestMsg, e *HandlerEntry) (ResponseMsg, error) {
+	records := []string{}
+	var size int64
+	var f *os.File
+	fail := func(rm ResponseMsg, err error) (ResponseMsg, error) {
+		if f != nil {
+			f.Close()
+			deleteFilesForExtProc([]string{f.Name()}, e)
+		}
+		return rm, err
+	}
+
+	br := bufio.NewReader(r.Body)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fail(bodyError(e, err))
+		}
+		rec := bytes.TrimSpace(sanitize.StripInvisibleBytes(line))
+		if len(rec) > 0 {
+			if !json.Valid(rec) {
+				return fail(decodeFail(e, "Invalid JSON in line "+strconv.Itoa(n)))
+			}
+			size += int64(len(rec)) + 1
+			records = append(records, string(rec))
+		}
+		if f == nil && !req.inline && size > spillThreshold {
+			var ferr error
+			if f, ferr = createFileForExtProc(); ferr != nil {
+				return decodeFail(e, "Failed to create file for external process")
+			}
+		}
+		if f != nil {
+			for _, rec := range records {
+				if _, err := f.WriteString(rec + "\n"); err != nil {
+					return fail(decodeFail(e, "Failed to create file for external process"))
+				}
+			}
+			records = records[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if f == nil {
+		req.Body = records
+		return decodeOk(e, "Set message body")
+	}
+	f.Close()
+	req.BodyFile = f.Name()
+	return decodeOk(e, "Set message body file")
+}
+
+// ---------------- Responses ----------------
+
+// Bytes, smaller response bodies are not worth compressing
+const minCompressSize = 1024
+
+// Headers the external process may not set, the server manages these
+var reservedResponseHeaders = []string{"Connection", "Content-Length", "Keep-Alive", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+/* Write the external process reply to the HTTP client. By default the reply message itself is
+ * written as JSON with 202 (ok) or 400 (not ok), unless the external process set the status code,
+ * headers, content type or body of the response. reqFiles are the files the server created for
+ * the request, the only body files it sends back (and removes). */
+func writeResponse(w http.ResponseWriter, r *http.Request, resp ResponseMsg, e *HandlerEntry, reqFiles []string) {
+	status := http.StatusBadRequest
+	if resp.Ok {
+		status = http.StatusAccepted
+	}
+	if !resp.isCustom() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		jm, _ := json.Marshal(resp)
+		w.Write(jm)
+		return
+	}
+
+	if resp.HttpStatus != 0 {
+		if resp.HttpStatus < 200 || resp.HttpStatus > 599 {
+			logThis(LogLine{"response:write", "fail", "invalid status code " + strconv.Itoa(resp.HttpStatus), e.SocketFile, serverUID, e.ExternalProcessID})
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		status = resp.HttpStatus
+	}
+
+	var body []byte
+	var file *os.File
+	switch {
+	case resp.BodyFile != "":
+		path := filepath.Clean(resp.BodyFile)
+		if !slices.Contains(reqFiles, path) {
+			// The server must not send (and remove) files it didn't create for the request
+			logThis(LogLine{"response:write", "fail", "body file not created for the request", path, serverUID, e.ExternalProcessID})
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		f, err := openBodyFile(path)
+		if err != nil {
+			logThis(LogLine{"open:file", "fail", err.Error(), path, serverUID, e.ExternalProcessID})
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer func() {
+			f.Close()
+			if err := os.Remove(path); err != nil {
+				logThis(LogLine{"remove:file", "fail", err.Error(), path, serverUID, e.ExternalProcessID})
+			}
+		}()
+		file = f
+
+	case resp.Body != nil:
+		if str, ok := resp.Body.(string); ok {
+			body = []byte(str)
+		} else {
+			body, _ = json.Marshal(resp.Body)
+			if resp.ContentType == "" {
+				resp.ContentType = "application/json"
+			}
+		}
+	}
+
+	h := w.Header()
+	for name, values := range resp.Headers {
+		name = http.CanonicalHeaderKey(sanitize.StripInvisibleRunes(name))
+		if slices.Contains(reservedResponseHeaders, name) {
+			continue
+		}
+		for _, v := range values {
+			h.Add(name, sanitize.StripInvisibleRunes(v))
+		}
+	}
+	if resp.ContentType != "" {
+		h.Set("Content-Type", sanitize.StripInvisibleRunes(resp.ContentType))
+	}
+
+	var src io.Reader = bytes.NewReader(body)
+	size := int64(len(body))
+	if file != nil {
+		src = file
+		size = -1
+		if fi, err := file.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	coding := ""
+	if e.CompressResponse && size >= minCompressSize && h.Get("Content-Encoding") == "" {
+		coding = compress.Negotiate(r.Header.Get("Accept-Encoding"))
+	}
+	if coding == "" {
+		if size >= 0 {
+			h.Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		w.WriteHeader(status)
+		io.Copy(w, src)
+		return
+	}
+
+	// Detect content type before the content is compressed
+	if h.Get("Content-Type") == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(src, head)
+		h.Set("Content-Type", http.DetectContentType(head[:n]))
+		src = io.MultiReader(bytes.NewReader(head[:n]), src)
+	}
+	h.Set("Content-Encoding", coding)
+	h.Add("Vary", "Accept-Encoding")
+	w.WriteHeader(status)
+	cw := compress.NewWriter(coding, w)
+	io.Copy(cw, src)
+	cw.Close()
+}
+
+/* Open a response body file. Symbolic links and special files are refused, the server
+ * must not send (and remove) files the external process doesn't own. */
+func openBodyFile(path string) (*os.File, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, errors.New("not a regular file")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if opened, err := f.Stat(); err != nil || !os.SameFile(fi, opened) {
+		f.Close()
+		return nil, errors.New("file replaced while opening")
+	}
+	return f, nil
+}
+
+// ---------------- Command Socket ----------------
+
+type CommandReply struct {
+	Ok        bool           `json:"ok"`
+	Error     string         `json:"error,omitempty"`
+	Token     string         `json:"token,omitempty"`      // Server generated one time token (register)
+	Path      string         `json:"path,omitempty"`       // Server generated path (register)
+	ExpiresAt string         `json:"expires_at,omitempty"` // Server generated path expiry, RFC 3339 (register, renew, touch)
+	Count     int            `json:"count,omitempty"`      // Resources removed (deregister_all)
+	Resources []ResourceInfo `json:"resources,omitempty"`  // Registered resources (list, inspect)
+}
+
+// Resource state as seen by operators
+type ResourceInfo struct {
+	Path              string   `json:"path"`
+	ExternalProcessID string   `json:"external_process_id"`
+	SocketFile        string   `json:"socket_file"`
+	AllowedMethods    []string `json:"allowed_methods"`
+	Mode              string   `json:"mode"`
+	Shots             int      `json:"shots,omitempty"`
+	Protocol          string   `json:"protocol"`
+	Timeout           int      `json:"timeout"`              // Remaining, in seconds, -1 => never times out
+	ExpiresAt         string   `json:"expires_at,omitempty"` // Deadline, RFC 3339
+	Enabled           bool     `json:"enabled"`
+	Handling          bool     `json:"handling"`
+	Handled           bool     `json:"handled"`
+	Queued            int      `json:"queued"`
+	InFlight          int      `json:"in_flight"`
+	Hits              int      `json:"hits"`
+	Relayed           int      `json:"relayed"`
+	Accepted          int      `json:"accepted"`
+	Spooled           int      `json:"spooled,omitempty"`   // Stored requests waiting for delivery
+	LastSeen          string   `json:"last_seen,omitempty"` // Last owner heartbeat, RFC 3339, heartbeats only
+	PeerPID           int32    `json:"peer_pid,omitempty"`  // Verified pid of the registering process
+	Via               string   `json:"via,omitempty"`       // Channel the resource was registered on
+}
+
+// Methods the server does not relay
+func validMethods(methods []string) bool {
+	return !slices.Contains(methods, http.MethodConnect) && !slices.Contains(methods, http.MethodHead) && !slices.Contains(methods, http.MethodOptions) && !slices.Contains(methods, http.MethodTrace)
+}
+
+func register(cmd Command, mux *DynamicMux) CommandReply {
+	if draining.Load() {
+		return CommandReply{Ok: false, Error: "server shutting down"}
+	}
+	if !validMethods(cmd.AllowedMethods) {
+		return CommandReply{Ok: false, Error: "invalid method"}
+	}
+
+	if !validSocketFile(cmd.SocketFile) {
+		return CommandReply{Ok: false, Error: "invalid socket file"}
+	}
+	switch cmd.Mode {
+	case "":
+		cmd.Mode = modeSingle
+	case modeSingle, modePersistent:
+	case modeMulti:
+		if cmd.Shots < 1 {
+			return CommandReply{Ok: false, Error: "invalid shots"}
+		}
+	default:
+		return CommandReply{Ok: false, Error: "invalid mode"}
+	}
+	switch cmd.Protocol {
+	case "":
+		cmd.Protocol = protocolPerRequest
+	case protocolPerRequest, protocolPersistent:
+	default:
+		return CommandReply{Ok: false, Error: "invalid protocol"}
+	}
+	if cmd.MaxInFlight == 0 {
+		cmd.MaxInFlight = 1
+	} else if cmd.MaxInFlight < 0 || cmd.MaxInFlight > maxQueueDepth {
+		return CommandReply{Ok: false, Error: "invalid max in flight"}
+	} else if cmd.MaxInFlight > 1 && (cmd.Protocol != protocolPersistent || cmd.Mode != modePersistent) {
+		// Concurrent requests could use more shots than there are
+		return CommandReply{Ok: false, Error: "max in flight requires persistent protocol and mode"}
+	}
+	if cmd.HeartbeatInterval < 0 {
+		return CommandReply{Ok: false, Error: "invalid heartbeat interval"}
+	}
+	if cmd.Spool && spooler == nil {
+		return CommandReply{Ok: false, Error: "spool not enabled on this server"}
+	}
+	if cmd.ResponseFile && strings.HasPrefix(cmd.SocketFile, tcpPrefix) {
+		return CommandReply{Ok: false, Error: "response file requires a unix socket"}
+	}
+	if cmd.QueueDepth < 0 || cmd.QueueDepth > maxQueueDepth {
+		return CommandReply{Ok: false, Error: "invalid queue depth"}
+	} else if cmd.QueueWait < 0 {
+		return CommandReply{Ok: false, Error: "invalid queue wait"}
+	}
+	if cmd.Verify != nil {
+		if err := cmd.Verify.Validate(); err != nil {
+			return CommandReply{Ok: false, Error: err.Error()}
+		}
+	}
+	var token string
+	if cmd.Auth != nil {
+		if err := cmd.Auth.Validate(); err != nil {
+			return CommandReply{Ok: false, Error: err.Error()}
+		}
+		var err error
+		if token, err = cmd.Auth.Prepare(); err != nil {
+			return CommandReply{Ok: false, Error: err.Error()}
+		}
+	}
+
+	if cmd.MaxBodySize < 0 || cmd.MaxBodySize > maxBodySize {
+		return CommandReply{Ok: false, Error: "invalid max body size"}
+	}
+	for i, ct := range cmd.ContentTypes {
+		cmd.ContentTypes[i] = strings.ToLower(strings.TrimSpace(ct))
+		if decoderFor(cmd.ContentTypes[i]) == nil {
+			return CommandReply{Ok: false, Error: "unsupported content type " + ct}
+		}
+	}
+	for i, k := range cmd.RequiredQuery {
+		cmd.RequiredQuery[i] = sanitize.StripInvisibleRunes(strings.TrimSpace(k))
+		if cmd.RequiredQuery[i] == "" {
+			return CommandReply{Ok: false, Error: "invalid required query key"}
+		}
+	}
+
+	cmd.Path = strings.TrimSpace(cmd.Path)
+	cmd.Path = sanitize.StripInvisibleRunes(cmd.Path)
+	if cmd.GeneratePath {
+		// Path is the (static) prefix of the generated path
+		prefix := strings.TrimRight(cmd.Path, "/")
+		if prefix != "" {
+			if p, err := route.Parse(prefix); err != nil || !p.IsStatic() {
+				return CommandReply{Ok: false, Error: "invalid path prefix"}
+			}
+		}
+		segment, err := route.RandomSegment()
+		if err != nil {
+			return CommandReply{Ok: false, Error: err.Error()}
+		}
+		cmd.Path = prefix + "/" + segment
+	}
+	pattern, err := route.Parse(cmd.Path)
+	if err != nil {
+		return CommandReply{Ok: false, Error: "invalid path: " + err.Error()}
+	}
+
+	mux.mu.Lock()
+	if _, exists := mux.handlers[cmd.Path]; exists {
+		mux.mu.Unlock()
+		return CommandReply{Ok: false, Error: "path already registered"}
+	}
+	// Templates that only differ in parameter names match the same paths
+	for _, v := range mux.handlers {
+		if v.Route.Shape() == pattern.Shape() {
+			mux.mu.Unlock()
+			return CommandReply{Ok: false, Error: "path already registered"}
+		}
+	}
+	/* Preemptive key reservation, requests that arrive in the meantime
+	 * wait for their turn until the entry is ready */
+	e := &HandlerEntry{
+		Enabled:       true,
+		Handling:      true,
+		Route:         pattern,
+		RequiredQuery: cmd.RequiredQuery,
+		MaxInFlight:   cmd.MaxInFlight,
+		turn:          make(chan struct{}, cmd.MaxInFlight)}
+	for range cmd.MaxInFlight {
+		e.turn <- struct{}{}
+	}
+	// Register before unlocking to prevent double registration in the meantime
+	mux.handlers[cmd.Path] = e
+	mux.mu.Unlock()
+
+	e.mu.Lock()
+	e.Enabled = true
+	e.Handling = false // Set the entry ready for service
+	e.Handled = false
+	e.SocketFile = cmd.SocketFile
+	e.ExternalProcessID = cmd.ExternalProcessID
+	e.Lifetime = cmd.Timeout
+	e.Mode = cmd.Mode
+	e.Shots = cmd.Shots
+	e.QueueDepth = cmd.QueueDepth
+	e.QueueWait = cmd.QueueWait
+	e.Verify = cmd.Verify
+	e.MaxBodySize = cmd.MaxBodySize
+	e.CompressResponse = cmd.CompressResponse
+	e.ResponseFile = cmd.ResponseFile
+	e.Spool = cmd.Spool
+	if len(cmd.ContentTypes) == 0 {
+		e.ContentTypes = defaultContentTypes
+	} else {
+		e.ContentTypes = cmd.ContentTypes
+	}
+	e.Auth = cmd.Auth
+	if e.QueueDepth > 0 && e.QueueWait == 0 {
+		e.QueueWait = timeoutReadExtProc
+	}
+	if e.Mode == modePersistent && e.Lifetime <= 0 {
+		e.Lifetime = -1 // Run until deregistered
+	} else if e.Lifetime < 0 {
+		e.Lifetime = 0
+	}
+
+	if len(cmd.AllowedMethods) == 0 {
+		e.AllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	} else {
+		e.AllowedMethods = cmd.AllowedMethods
+	}
+
+	if cmd.Protocol == protocolPersistent {
+		e.conn = newHandlerConn(e.SocketFile)
+	}
+	now := time.Now()
+	e.HeartbeatInterval = cmd.HeartbeatInterval
+	e.LastSeen = now
+	e.expireIn(e.Lifetime, now)
+	e.PeerPID = cmd.peer.PID
+	e.PeerUID = cmd.peer.UID
+	e.Via = cmd.via
+	e.registered = cmd
+	e.registered.Secret = ""
+	e.registered.GeneratePath = false // Path is final
+	schedule(cmd.Path, e)
+	persist(cmd.Path, e)
+	deadline := e.Deadline
+
+	e.mu.Unlock()
+	for range cmd.MaxInFlight {
+		<-e.turn // Ready for service
+	}
+	reply := CommandReply{Ok: true, Token: token}
+	if cmd.GeneratePath {
+		reply.Path = cmd.Path
+		if cmd.Timeout > 0 {
+			reply.ExpiresAt = deadline.UTC().Format(time.RFC3339)
+		}
+	}
+	return reply
+}
+
+/* Resource at cmd.Path if cmd.ExternalProcessID owns it, caller holds mux.mu.
+ * Otherwise the error reply. */
+func owned(cmd Command, mux *DynamicMux) (*HandlerEntry, CommandReply) {
+	e := mux.handlers[cmd.Path]
+	if e == nil || cmd.Path == "/ping" {
+		return nil, CommandReply{Ok: false, Error: "resource not found"}
+	} else if !e.ownedBy(cmd) {
+		return nil, CommandReply{Ok: false, Error: "wrong resource owner"}
+	}
+	return e, CommandReply{Ok: true}
+}
+
+func deregister(cmd Command, mux *DynamicMux) CommandReply {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	e, reply := owned(cmd, mux)
+	if e == nil {
+		return reply
+	}
+
+	e.retire()
+	delete(mux.handlers, cmd.Path)
+	expiries.Cancel(cmd.Path)
+	unpersist(cmd.Path)
+	return reply
+}
+
+// Remove all resources of the external process, e.g. before it exits
+func deregisterAll(cmd Command, mux *DynamicMux) CommandReply {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	count := 0
+	for k, e := range mux.handlers {
+		if k == "/ping" || !e.ownedBy(cmd) {
+			continue
+		}
+
+		e.retire()
+		delete(mux.handlers, k)
+		expiries.Cancel(k)
+		unpersist(k)
+		logThis(LogLine{"deregister", "ok", "deregister_all", k, serverUID, cmd.ExternalProcessID})
+		count++
+	}
+	if count == 0 {
+		return CommandReply{Ok: false, Error: "resource not found"}
+	}
+	return CommandReply{Ok: true, Count: count}
+}
+
+/* Move the deadline: RENEW to cmd.Timeout seconds from now (or the registered
+ * timeout when 0), TOUCH always to the registered timeout */
+func renew(cmd Command, mux *DynamicMux) CommandReply {
+	if cmd.Timeout < 0 {
+		return CommandReply{Ok: false, Error: "invalid timeout"}
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	e, reply := owned(cmd, mux)
+	if e == nil {
+		return reply
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.Enabled {
+		return CommandReply{Ok: false, Error: "resource not found"}
+	}
+	timeout := cmd.Timeout
+	if cmd.Command == "touch" || timeout == 0 {
+		timeout = e.Lifetime
+	}
+	e.expireIn(timeout, time.Now())
+	schedule(cmd.Path, e)
+	persist(cmd.Path, e)
+	if !e.Deadline.IsZero() {
+		reply.ExpiresAt = e.Deadline.UTC().Format(time.RFC3339)
+	}
+	return reply
+}
+
+/* Change allowed methods and/or socket file in place, requests already
+ * relayed complete on the previous socket file */
+func update(cmd Command, mux *DynamicMux) CommandReply {
+	if len(cmd.AllowedMethods) == 0 && cmd.SocketFile == "" {
+		return CommandReply{Ok: false, Error: "nothing to update"}
+	} else if !validMethods(cmd.AllowedMethods) {
+		return CommandReply{Ok: false, Error: "invalid method"}
+	} else if cmd.SocketFile != "" && !validSocketFile(cmd.SocketFile) {
+		return CommandReply{Ok: false, Error: "invalid socket file"}
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	e, reply := owned(cmd, mux)
+	if e == nil {
+		return reply
+	}
+
+	e.mu.Lock()
+	if e.ResponseFile && strings.HasPrefix(cmd.SocketFile, tcpPrefix) {
+		e.mu.Unlock()
+		return CommandReply{Ok: false, Error: "response file requires a unix socket"}
+	}
+	if len(cmd.AllowedMethods) > 0 {
+		e.AllowedMethods = cmd.AllowedMethods
+	}
+	var old *handlerConn
+	if cmd.SocketFile != "" && cmd.SocketFile != e.SocketFile {
+		e.SocketFile = cmd.SocketFile
+		if e.conn != nil {
+			old = e.conn
+			e.conn = newHandlerConn(e.SocketFile)
+		}
+	}
+	persist(cmd.Path, e)
+	e.mu.Unlock()
+
+	if old != nil {
+		// Let requests in flight on the previous connection complete (or time out)
+		time.AfterFunc(time.Duration(timeoutReadExtProc)*time.Second, old.close)
+	}
+	return reply
+}
+
+func (e *HandlerEntry) info(path string) ResourceInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	protocol := protocolPerRequest
+	if e.conn != nil {
+		protocol = protocolPersistent
+	}
+	ri := ResourceInfo{
+		Path:              path,
+		ExternalProcessID: e.ExternalProcessID,
+		SocketFile:        e.SocketFile,
+		AllowedMethods:    e.AllowedMethods,
+		Mode:              e.Mode,
+		Shots:             e.Shots,
+		Protocol:          protocol,
+		Timeout:           -1,
+		Enabled:           e.Enabled,
+		Handling:          e.Handling,
+		Handled:           e.Handled,
+		Queued:            e.Queued,
+		InFlight:          e.InFlight,
+		Hits:              e.Hits,
+		Relayed:           e.Relayed,
+		Accepted:          e.Accepted,
+		Spooled:           e.Spooled,
+		PeerPID:           e.PeerPID,
+		Via:               e.Via,
+	}
+	if !e.Deadline.IsZero() {
+		ri.Timeout = max(int((time.Until(e.Deadline)+time.Second-1)/time.Second), 0) // Rounded up
+		ri.ExpiresAt = e.Deadline.UTC().Format(time.RFC3339)
+	}
+	if e.HeartbeatInterval > 0 {
+		ri.LastSeen = e.LastSeen.UTC().Format(time.RFC3339)
+	}
+	return ri
+}
+
+// All resources, sorted by path (/ping excluded)
+func list(mux *DynamicMux) CommandReply {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	resources := make([]ResourceInfo, 0, len(mux.handlers))
+	for k, e := range mux.handlers {
+		if k == "/ping" {
+			continue
+		}
+		resources = append(resources, e.info(k))
+	}
+	slices.SortFunc(resources, func(a, b ResourceInfo) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return CommandReply{Ok: true, Resources: resources}
+}
 
+func inspect(cmd Command, mux *DynamicMux) CommandReply {
 	mux.mu.Lock()
-	if _, exists := mux.handlers[cmd.Path]; exists {
-		mux.mu.Unlock()
-		return CommandReply{Ok: false, Error: "path already registered"}
+	defer mux.mu.Unlock()
+
+	e := mux.handlers[cmd.Path]
+	if e == nil || cmd.Path == "/ping" {
+		return CommandReply{Ok: false, Error: "resource not found"}
+	}
+	return CommandReply{Ok: true, Resources: []ResourceInfo{e.info(cmd.Path)}}
+}
+
+// Owner is alive, applies to all its resources
+func heartbeat(cmd Command, mux *DynamicMux) CommandReply {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	found := false
+	now := time.Now()
+	for k, e := range mux.handlers {
+		if k == "/ping" || !e.ownedBy(cmd) {
+			continue
+		}
+
+		e.mu.Lock()
+		e.LastSeen = now
+		e.mu.Unlock()
+		found = true
+	}
+	if !found {
+		return CommandReply{Ok: false, Error: "resource not found"}
 	}
-	// Preemptive key reservation
+	return CommandReply{Ok: true}
+}
+
+/* Register /ping resource so external processes/clients can check if server
+ * is running. This resource always exists */
+func registerPing(mux *DynamicMux) {
+	path := "/ping"
+	pattern, _ := route.Parse(path)
 	e := &HandlerEntry{
-		Enabled:  true,
-		Handling: true}
-	// Register before unlocking to prevent double registration in the meantime
-	mux.handlers[cmd.Path] = e
+		Enabled:           true,
+		Handling:          false,
+		Handled:           false,
+		SocketFile:        "",
+		ExternalProcessID: "",
+		AllowedMethods:    []string{http.MethodGet},
+		Route:             pattern, // Never expires
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pingPong := PingPong{
+				Message:   "pong",
+				Status:    status,
+				Now:       time.Now().Format(time.DateTime),
+				ServerUid: serverUID,
+			}
+			jm, _ := json.Marshal(pingPong)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jm)
+		}),
+	}
+
+	mux.mu.Lock()
+	mux.handlers[path] = e
 	mux.mu.Unlock()
+	logThis(LogLine{"register", "ok", "", path, serverUID, ""})
+}
 
-	e.mu.Lock()
-	e.Enabled = true
-	e.Handling = false // Set the entry ready for service
-	e.Handled = false
-	e.SocketFile = cmd.SocketFile
-	e.ExternalProcessID = cmd.ExternalProcessID
-	e.Timeout = cmd.Timeout
+func listenForClient(listener net.Listener, ctx context.Context, mux *DynamicMux) {
+	// Accept() blocks until the listener is closed
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			if err == nil {
+				conn.Close()
+			}
+			logThis(LogLine{"conn:accept", "ok", "context done", cmdSockPath, serverUID, ""})
+			return
+		} else if err != nil {
+			logThis(LogLine{"conn:accept", "fail", err.Error(), cmdSockPath, serverUID, ""})
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		handleClient(conn, mux)
+	}
+}
+
+func handleClient(conn net.Conn, mux *DynamicMux) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+
+	peer, err := peercred.Get(conn)
+	if err != nil && (!errors.Is(err, peercred.ErrUnsupported) || len(cmdPolicy.UIDs) > 0 || len(cmdPolicy.GIDs) > 0) {
+		logThis(LogLine{"conn:auth", "fail", err.Error(), cmdSockPath, serverUID, ""})
+		enc.Encode(CommandReply{Ok: false, Error: "permission denied"})
+		return
+	} else if err == nil && !cmdPolicy.Allows(peer) {
+		reason := fmt.Sprintf("peer not allowed: pid %d uid %d gid %d", peer.PID, peer.UID, peer.GID)
+		logThis(LogLine{"conn:auth", "fail", reason, cmdSockPath, serverUID, ""})
+		enc.Encode(CommandReply{Ok: false, Error: "permission denied"})
+		return
+	}
+
+	var cmd Command
+	err = dec.Decode(&cmd)
+	if err != nil {
+		var reason string
+		if err == io.EOF {
+			reason = "empty string"
+			return
+		} else {
+			reason = err.Error()
+		}
+
+		enc.Encode(CommandReply{Ok: false, Error: reason})
+		return
+	}
+	if len(commandSecret) > 0 && subtle.ConstantTimeCompare([]byte(cmd.Secret), commandSecret) != 1 {
+		logThis(LogLine{"conn:auth", "fail", "invalid secret", cmdSockPath, serverUID, cmd.ExternalProcessID})
+		enc.Encode(CommandReply{Ok: false, Error: "permission denied"})
+		return
+	}
+	cmd.peer = peer
+	cmd.via = viaCommandSocket
+
+	resp := execute(cmd, mux)
+	if err := enc.Encode(resp); err != nil {
+		logThis(LogLine{"client:request:reply", "fail", err.Error(), cmdSockPath, serverUID, cmd.ExternalProcessID})
+		return
+	}
+}
+
+// Run a command from the command socket or the control API
+func execute(cmd Command, mux *DynamicMux) CommandReply {
+	var resp CommandReply
+	switch cmd.Command {
+	case "register":
+		resp = register(cmd, mux)
+	case "deregister":
+		resp = deregister(cmd, mux)
+	case "deregister_all":
+		resp = deregisterAll(cmd, mux)
+	case "renew", "touch":
+		resp = renew(cmd, mux)
+	case "update":
+		resp = update(cmd, mux)
+	case "heartbeat":
+		resp = heartbeat(cmd, mux)
+	case "list":
+		resp = list(mux)
+	case "inspect":
+		resp = inspect(cmd, mux)
+	default:
+		resp = CommandReply{Ok: false, Error: "unknown command"}
+	}
+
+	if resp.Ok && slices.Contains([]string{"register", "deregister", "renew", "touch", "update"}, cmd.Command) { // Others would flood the log
+		logThis(LogLine{cmd.Command, "ok", "", cmd.Path, serverUID, cmd.ExternalProcessID})
+	}
+	return resp
+}
+
+// ---------------- Control API ----------------
+
+/* HTTP JSON control API, for external processes that don't share a filesystem with the server:
+ *  - GET /resources                                  list
+ *  - POST /resources (body: Command)                 register
+ *  - DELETE /resources?path=P&external_process_id=X  deregister
+ * Every request must carry the bearer token. Peer credentials are not available, API
+ * clients only change resources registered on the API (same ExternalProcessID). */
+func controlAPI(mux *DynamicMux, token *auth.Options) http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /resources", func(w http.ResponseWriter, r *http.Request) {
+		writeCommandReply(w, execute(Command{Command: "list"}, mux), http.StatusOK)
+	})
+	api.HandleFunc("POST /resources", func(w http.ResponseWriter, r *http.Request) {
+		var cmd Command
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err := dec.Decode(&cmd); err != nil {
+			writeCommandReply(w, CommandReply{Ok: false, Error: err.Error()}, http.StatusOK)
+			return
+		}
+		cmd.Command = "register"
+		cmd.via = viaControlAPI
+		writeCommandReply(w, execute(cmd, mux), http.StatusCreated)
+	})
+	api.HandleFunc("DELETE /resources", func(w http.ResponseWriter, r *http.Request) {
+		cmd := Command{
+			Command:           "deregister",
+			Path:              r.URL.Query().Get("path"),
+			ExternalProcessID: r.URL.Query().Get("external_process_id"),
+			via:               viaControlAPI,
+		}
+		writeCommandReply(w, execute(cmd, mux), http.StatusOK)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.Check(token, r); err != nil {
+			logThis(LogLine{"control:auth", "fail", err.Error(), r.URL.Path, serverUID, ""})
+			w.Header().Set("WWW-Authenticate", token.Challenge())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+}
+
+// Command reply with an HTTP status code matching the error
+func writeCommandReply(w http.ResponseWriter, reply CommandReply, okStatus int) {
+	code := okStatus
+	if !reply.Ok {
+		switch reply.Error {
+		case "resource not found":
+			code = http.StatusNotFound
+		case "wrong resource owner":
+			code = http.StatusForbidden
+		case "path already registered":
+			code = http.StatusConflict
+		default:
+			code = http.StatusBadRequest
+		}
+	}
+
+	jm, _ := json.Marshal(reply)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(jm)
+}
+
+// ---------------- Housekeeping ----------------
+
+// Resource deadlines and owner heartbeat checks, earliest first
+var expiries = expiry.New()
+
+// Queue the next check of the resource, caller holds e.mu
+func schedule(path string, e *HandlerEntry) {
+	if at := e.nextCheck(); !at.IsZero() {
+		expiries.Schedule(path, at)
+	} else {
+		expiries.Cancel(path)
+	}
+}
+
+// Why the resource must be removed, empty if it stays. Caller holds e.mu
+func (e *HandlerEntry) removal(now time.Time) string {
+	switch {
+	case !e.Enabled && e.Handled:
+		return "handled"
+	case e.expired(now):
+		return "timeout"
+	case e.ownerDead(now):
+		return "owner dead"
+	}
+	return ""
+}
+
+/* Remove used, expired and abandoned resources when their check is due, instead of
+ * scanning all resources. In ephemeral mode shut down the server once it has been
+ * idle (no resources) for idleShutdown, which also gives time to register at startup */
+func housekeeping(parent context.Context, cancel context.CancelFunc, mux *DynamicMux) {
+	logThis(LogLine{"housekeep", "start", serverMode, "", serverUID, ""})
+	idleSince := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-parent.Done():
+			os.Remove(cmdSockPath) // Remove command socket file
+			logThis(LogLine{"shutdown", "ok", "context done", "func housekeeping()", serverUID, ""})
+			return
+
+		case <-expiries.Wake():
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		mux.mu.Lock()
+		removeDue(mux, now)
+		remaining := len(mux.handlers) - 1 // -1 is /ping (this resource always exists)
+		mux.mu.Unlock()
+
+		wait := time.Duration(-1)
+		if at, ok := expiries.Next(); ok {
+			wait = at.Sub(now)
+		}
+		if remaining > 0 {
+			idleSince = time.Time{}
+		} else if idleSince.IsZero() {
+			idleSince = now
+		}
+		if serverMode == config.ModeEphemeral && remaining == 0 {
+			if now.Sub(idleSince) >= idleShutdown {
+				logThis(LogLine{"shutdown", "ok", "no resources available", "", serverUID, ""})
+				status = "shutdown"
+				cancel()
+				continue
+			}
+			if idle := idleSince.Add(idleShutdown).Sub(now); wait < 0 || idle < wait {
+				wait = idle
+			}
+		}
+		if wait >= 0 {
+			timer.Reset(wait)
+		} else {
+			timer.Stop() // Nothing due, wait for a schedule change
+		}
+	}
+}
+
+// Remove the resources whose check is due and must go, schedule the next check of the others. Caller holds mux.mu
+func removeDue(mux *DynamicMux, now time.Time) {
+	for _, k := range expiries.Due(now) {
+		v := mux.handlers[k]
+		if v == nil {
+			continue
+		}
+
+		v.mu.Lock()
+		handling, reason := v.Handling, v.removal(now)
+		if reason == "" {
+			schedule(k, v) // Busy or not, it must be checked again
+		}
+		v.mu.Unlock()
+		if handling || reason == "" {
+			continue // Busy resources due for removal are scheduled again by release()
+		}
+
+		_, err := os.Stat(v.SocketFile)
+		if err == nil && !socketFileShared(mux, k, v.SocketFile) {
+			os.Remove(v.SocketFile)
+			logThis(LogLine{"remove:file", "ok", reason, v.SocketFile, serverUID, v.ExternalProcessID})
+		}
+
+		tempUID := v.ExternalProcessID
+		v.retire()
+		delete(mux.handlers, k)
+		unpersist(k)
+		logThis(LogLine{"remove:resource", "ok", reason, k, serverUID, tempUID})
+	}
+}
+
+// Another resource relays to the same socket file, caller holds mux.mu
+func socketFileShared(mux *DynamicMux, path, socketFile string) bool {
+	for k, e := range mux.handlers {
+		if k == path {
+			continue
+		}
+		e.mu.Lock()
+		shared := e.SocketFile == socketFile
+		e.mu.Unlock()
+		if shared {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------- Drain ----------------
+
+var draining atomic.Bool // Set once, new requests are answered with 503
+var active atomic.Int64  // Requests being queued, relayed or answered
+
+/* Stop relaying requests, wait (at most timeout) for requests in flight to complete,
+ * then tell every resource owner and remove the resources and their socket files.
+ * Reports whether all requests in flight completed. */
+func drain(mux *DynamicMux, reason string, timeout time.Duration) bool {
+	draining.Store(true)
+	status = "draining"
+	logThis(LogLine{"drain", "start", reason, "", serverUID, ""})
+
+	deadline := time.Now().Add(timeout)
+	for active.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+	drained := active.Load() == 0
+	if !drained {
+		logThis(LogLine{"drain", "fail", fmt.Sprintf("%d requests in flight", active.Load()), "", serverUID, ""})
+	}
+
+	mux.mu.Lock()
+	entries := make(map[string]*HandlerEntry, len(mux.handlers))
+	for k, v := range mux.handlers {
+		if k == "/ping" {
+			continue
+		}
+		entries[k] = v
+		delete(mux.handlers, k)
+	}
+	mux.mu.Unlock()
+
+	for k, v := range entries {
+		v.mu.Lock()
+		socketFile, hc := v.SocketFile, v.conn
+		v.mu.Unlock()
+
+		msg := ShutdownMsg{Event: "shutdown", Path: k, Reason: reason, Persisted: journal != nil, InstanceUID: serverUID}
+		if err := notifyShutdown(socketFile, hc, msg); err != nil {
+			logThis(LogLine{"notify:shutdown", "fail", err.Error(), k, serverUID, v.ExternalProcessID})
+		} else {
+			logThis(LogLine{"notify:shutdown", "ok", reason, k, serverUID, v.ExternalProcessID})
+		}
+
+		v.retire()
+		if journal != nil {
+			// The owner keeps listening, the next server instance relays to it
+			logThis(LogLine{"remove:resource", "ok", "shutdown, kept in registry", k, serverUID, v.ExternalProcessID})
+			continue
+		}
+		if network, addr := handlerNetwork(socketFile); network == "unix" {
+			if _, err := os.Stat(addr); err == nil {
+				os.Remove(addr)
+				logThis(LogLine{"remove:file", "ok", "shutdown", addr, serverUID, v.ExternalProcessID})
+			}
+		}
+		logThis(LogLine{"remove:resource", "ok", "shutdown", k, serverUID, v.ExternalProcessID})
+	}
+
+	if drained {
+		logThis(LogLine{"drain", "ok", reason, "", serverUID, ""})
+	}
+	return drained
+}
+
+// Shutdown message over the persistent connection, or a new connection
+func notifyShutdown(socketFile string, hc *handlerConn, msg ShutdownMsg) error {
+	if hc != nil && hc.notify(msg, time.Second) == nil {
+		return nil
+	}
+
+	network, addr := handlerNetwork(socketFile)
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	return json.NewEncoder(conn).Encode(msg)
+}
+
+// ---------------- Registry ----------------
+
+var journal *registry.Registry // nil => registrations are not persisted
+
+// Write the resource state to the registry, caller holds e.mu
+func persist(path string, e *HandlerEntry) {
+	if journal == nil {
+		return
+	}
+
+	cmd := e.registered
+	cmd.Path = path
+	cmd.SocketFile = e.SocketFile
+	cmd.AllowedMethods = e.AllowedMethods
+	cmd.Timeout = max(e.Lifetime, 0)
+	if e.Auth != nil && e.Auth.Scheme == auth.OneTime && e.Auth.Revoked() {
+		// Restored without a token, nobody can use it
+		cmd.Auth = &auth.Options{Scheme: auth.OneTime}
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		logThis(LogLine{"registry:write", "fail", err.Error(), path, serverUID, e.ExternalProcessID})
+		return
+	}
+
+	ent := registry.Entry{Path: path, Command: b, Shots: e.Shots, PeerPID: e.PeerPID, PeerUID: e.PeerUID, Via: e.Via}
+	if !e.Deadline.IsZero() {
+		ent.ExpiresAt = e.Deadline.Unix()
+	}
+	if err := journal.Put(ent); err != nil {
+		logThis(LogLine{"registry:write", "fail", err.Error(), path, serverUID, e.ExternalProcessID})
+	}
+}
+
+func unpersist(path string) {
+	if journal == nil {
+		return
+	}
+	if err := journal.Remove(path); err != nil {
+		logThis(LogLine{"registry:write", "fail", err.Error(), path, serverUID, ""})
+	}
+}
+
+/* Owner of a restored resource is still running: the verified pid when known,
+ * otherwise its unix socket file still exists (TCP handlers are assumed alive) */
+func ownerAlive(ent registry.Entry, cmd Command) bool {
+	if ent.PeerPID > 0 {
+		return peercred.Alive(ent.PeerPID)
+	}
+	network, addr := handlerNetwork(cmd.SocketFile)
+	if network != "unix" {
+		return true
+	}
+	_, err := os.Stat(addr)
+	return err == nil
+}
+
+/* Register the resources found in the registry at startup. Expired resources and
+ * resources of owners that are gone are dropped, the others get the time they had left. */
+func restore(mux *DynamicMux, entries []registry.Entry) {
+	now := time.Now()
+	// Socket files of dropped resources, removed once the others are restored (they may share them)
+	var stale []LogLine
+	for _, ent := range entries {
+		var cmd Command
+		if err := json.Unmarshal(ent.Command, &cmd); err != nil {
+			logThis(LogLine{"restore", "fail", err.Error(), ent.Path, serverUID, ""})
+			unpersist(ent.Path)
+			continue
+		}
+
+		reason := ""
+		if ent.ExpiresAt > 0 && !now.Before(time.Unix(ent.ExpiresAt, 0)) {
+			reason = "timeout"
+		} else if ent.ExpiresAt == 0 && cmd.Mode != modePersistent {
+			reason = "timeout"
+		} else if !ownerAlive(ent, cmd) {
+			reason = "owner dead"
+		}
+		if reason != "" {
+			if network, addr := handlerNetwork(cmd.SocketFile); network == "unix" {
+				stale = append(stale, LogLine{"remove:file", "ok", reason, addr, serverUID, cmd.ExternalProcessID})
+			}
+			unpersist(ent.Path)
+			logThis(LogLine{"remove:resource", "ok", reason, ent.Path, serverUID, cmd.ExternalProcessID})
+			continue
+		}
+
+		lifetime := cmd.Timeout
+		cmd.Timeout = 0
+		if ent.ExpiresAt > 0 {
+			cmd.Timeout = max(int(time.Unix(ent.ExpiresAt, 0).Sub(now).Seconds()), 1)
+		}
+		if cmd.Mode == modeMulti {
+			cmd.Shots = ent.Shots
+		}
+		// The server generates one time tokens on register, keep the one the client has
+		var tokens []string
+		if cmd.Auth != nil && cmd.Auth.Scheme == auth.OneTime {
+			tokens, cmd.Auth.Tokens = cmd.Auth.Tokens, nil
+		}
+		cmd.peer = peercred.Cred{PID: ent.PeerPID, UID: ent.PeerUID}
+		cmd.via = ent.Via
 
-	if len(cmd.AllowedMethods) == 0 {
-		e.AllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
-	} else {
-		e.AllowedMethods = cmd.AllowedMethods
-	}
+		if reply := register(cmd, mux); !reply.Ok {
+			logThis(LogLine{"restore", "fail", reply.Error, ent.Path, serverUID, cmd.ExternalProcessID})
+			unpersist(ent.Path)
+			continue
+		}
 
-	e.mu.Unlock()
-	return CommandReply{Ok: true}
-}
+		mux.mu.Lock()
+		e := mux.handlers[cmd.Path]
+		mux.mu.Unlock()
+		e.mu.Lock()
+		if tokens != nil {
+			e.Auth.Tokens = tokens
+		} else if e.Auth != nil && e.Auth.Scheme == auth.OneTime {
+			e.Auth.Revoke() // Token was used
+		}
+		if e.Mode == modePersistent && lifetime <= 0 {
+			lifetime = -1
+		}
+		e.Lifetime = lifetime
+		if ent.ExpiresAt > 0 {
+			e.Deadline = time.Unix(ent.ExpiresAt, 0) // Not the rounded remaining seconds
+			schedule(cmd.Path, e)
+		}
+		persist(cmd.Path, e)
+		e.mu.Unlock()
+		logThis(LogLine{"restore", "ok", "", cmd.Path, serverUID, cmd.ExternalProcessID})
+	}
 
-func deregister(cmd Command, mux *DynamicMux) CommandReply {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
-
-	e := mux.handlers[cmd.Path]
-	if e == nil {
-		return CommandReply{Ok: false, Error: "resource not found"}
-	} else if e.ExternalProcessID != cmd.ExternalProcessID {
-		return CommandReply{Ok: false, Error: "wrong resource owner"}
+	for _, line := range stale {
+		if _, err := os.Stat(line.Resource); err == nil && !socketFileShared(mux, "", line.Resource) {
+			os.Remove(line.Resource)
+			logThis(line)
+		}
 	}
-
-	delete(mux.handlers, cmd.Path)
-	return CommandReply{Ok: true}
 }
 
-/* Register /ping resource so external processes/clients can check if server
- * is running. This resource always exists */
-func registerPing(mux *DynamicMux) {
-	path := "/ping"
-	e := &HandlerEntry{
-		Enabled:           true,
-		Handling:          false,
-		Handled:           false,
-		SocketFile:        "",
-		ExternalProcessID: "",
-		AllowedMethods:    []string{http.MethodGet},
-		Timeout:           -1, // Run forever
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			pingPong := PingPong{
-				Message:   "pong",
-				Status:    status,
-				Now:       time.Now().Format(time.DateTime),
-				ServerUid: serverUID,
-			}
-			jm, _ := json.Marshal(pingPong)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(jm)
-		}),
-	}
+// ---------------- Spool ----------------
 
-	mux.mu.Lock()
-	mux.handlers[path] = e
-	mux.mu.Unlock()
-	logThis(LogLine{"register", "ok", "", path, serverUID, ""})
+/* Requests for resources registered with spool are stored when the external process is
+ * unreachable and delivered later, at least once: after a read timeout the request is
+ * delivered again, external processes recognise it by its request ID. */
+var spooler *spool.Spool // nil => spool not enabled
+
+// Retry interval while the external process is busy with other requests (or the server drains)
+const spoolBusyWait = time.Second
+
+/* Store the request for later delivery. Single and multi mode resources don't
+ * get more stored requests than they have shots left. */
+func spoolRequest(key string, e *HandlerEntry, req RequestMsg, reason error) bool {
+	e.mu.Lock()
+	limit := 1
+	if e.Mode == modeMulti {
+		limit = e.Shots
+	}
+	if !e.Spool || (e.Mode != modePersistent && e.Spooled >= limit) {
+		e.mu.Unlock()
+		return false
+	}
+	e.Spooled++
+	e.mu.Unlock()
+	req.ResponseFile = "" // Removed with the request, spooled deliveries get no response to the client
+
+	// Temporary files don't survive a restart, the spool keeps them with the message
+	files, err := spooler.Keep(req.tempFiles())
+	var m *spool.Message
+	if err == nil {
+		req.setTempFiles(files)
+		m, err = spooler.Put(key, req, files, reason)
+	}
+	if err != nil {
+		logThis(LogLine{"spool:write", "fail", err.Error(), key, serverUID, e.ExternalProcessID})
+		e.mu.Lock()
+		e.Spooled--
+		e.mu.Unlock()
+		return false
+	}
+	logThis(LogLine{"spool:write", "ok", "message " + m.ID + ": " + reason.Error(), key, serverUID, e.ExternalProcessID})
+	return true
 }
 
-func listenForClient(listener net.Listener, ctx context.Context, mux *DynamicMux) {
-	defer listener.Close()
-	ticker := time.NewTicker(time.Millisecond)
+// Deliver stored requests when their next attempt is due
+func deliverSpooled(ctx context.Context, mux *DynamicMux) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			ticker.Stop()
-			logThis(LogLine{"conn:accept", "ok", "context done", cmdSockPath, serverUID, ""})
 			return
+		case <-spooler.Wake():
+		case <-timer.C:
+		}
 
-		case <-ticker.C:
-			conn, err := listener.Accept()
-			if err != nil {
-				logThis(LogLine{"conn:accept", "fail", err.Error(), cmdSockPath, serverUID, ""})
-				continue
-			}
-
-			handleClient(conn, mux)
+		for _, m := range spooler.Due(time.Now()) {
+			go deliver(mux, m)
+		}
+		if at, ok := spooler.Next(); ok {
+			timer.Reset(time.Until(at))
+		} else {
+			timer.Stop()
 		}
 	}
 }
 
-func handleClient(conn net.Conn, mux *DynamicMux) {
-	defer conn.Close()
+// Relay a stored request like ServeHTTP() does, without waiting in the queue
+func deliver(mux *DynamicMux, m *spool.Message) {
+	active.Add(1)
+	defer active.Add(-1)
+	if draining.Load() {
+		postpone(m) // Next server instance
+		return
+	}
 
-	dec := json.NewDecoder(bufio.NewReader(conn))
-	enc := json.NewEncoder(conn)
+	var req RequestMsg
+	if err := json.Unmarshal(m.Payload, &req); err != nil {
+		spoolDead(m, nil, err)
+		return
+	}
+	mux.mu.RLock()
+	e := mux.handlers[m.Route]
+	mux.mu.RUnlock()
+	if e == nil || m.Route == "/ping" {
+		// Deregistered or removed, it won't come back
+		spoolDead(m, nil, errors.New("resource not found"))
+		return
+	}
 
-	var cmd Command
-	err := dec.Decode(&cmd)
+	select {
+	case e.turn <- struct{}{}:
+	default:
+		postpone(m)
+		return
+	}
+	e.mu.Lock()
+	if !e.Enabled || e.expired(time.Now()) {
+		e.mu.Unlock()
+		<-e.turn
+		spoolDead(m, e, errors.New("resource not found"))
+		return
+	}
+	e.Queued++
+	e.InFlight++
+	e.Relayed++
+	e.Handling = true
+	socketFile, hc := e.SocketFile, e.conn
+	e.mu.Unlock()
+
+	resp, err := relay(socketFile, hc, req)
+	if err == nil {
+		e.settle(m.Route, resp)
+	}
+	e.release()
 	if err != nil {
-		var reason string
-		if err == io.EOF {
-			reason = "empty string"
-			return
-		} else {
-			reason = err.Error()
-		}
+		spoolFailed(m, e, err)
+		return
+	}
+	discardBodyFile(resp, req, e)
 
-		enc.Encode(CommandReply{Ok: false, Error: reason})
+	if err := spooler.Delivered(m); err != nil {
+		logThis(LogLine{"spool:write", "fail", err.Error(), m.Route, serverUID, e.ExternalProcessID})
+	}
+	e.mu.Lock()
+	e.Spooled--
+	e.mu.Unlock()
+	reason := "message " + m.ID
+	if !resp.Ok {
+		reason += ", not accepted by the external process" // Not retried, it's the external process decision
+	}
+	logThis(LogLine{"spool:deliver", "ok", reason, m.Route, serverUID, e.ExternalProcessID})
+}
+
+// Try again later, not a failed attempt
+func postpone(m *spool.Message) {
+	if err := spooler.Postpone(m, time.Now().Add(spoolBusyWait)); err != nil {
+		logThis(LogLine{"spool:write", "fail", err.Error(), m.Route, serverUID, ""})
+	}
+}
+
+// Delivery attempt failed, tried again after the backoff (up to MaxAttempts)
+func spoolFailed(m *spool.Message, e *HandlerEntry, reason error) {
+	dead, err := spooler.Failed(m, reason)
+	if err != nil {
+		logThis(LogLine{"spool:write", "fail", err.Error(), m.Route, serverUID, e.ExternalProcessID})
+	}
+	if !dead {
+		logThis(LogLine{"spool:deliver", "fail", fmt.Sprintf("message %s, attempt %d: %v", m.ID, m.Attempts, reason), m.Route, serverUID, e.ExternalProcessID})
 		return
 	}
+	deadLetter(m, e, reason)
+}
 
-	var resp CommandReply
-	switch cmd.Command {
-	case "register":
-		resp = register(cmd, mux)
-	case "deregister":
-		resp = deregister(cmd, mux)
-	default:
-		resp = CommandReply{Ok: false, Error: "unknown command"}
+// Delivery can never succeed, the message goes to the dead letter directory without more attempts
+func spoolDead(m *spool.Message, e *HandlerEntry, reason error) {
+	if err := spooler.Dead(m, reason); err != nil {
+		extProcID := ""
+		if e != nil {
+			extProcID = e.ExternalProcessID
+		}
+		logThis(LogLine{"spool:write", "fail", err.Error(), m.Route, serverUID, extProcID})
 	}
+	deadLetter(m, e, reason)
+}
 
-	if resp.Ok {
-		logThis(LogLine{cmd.Command, "ok", "", cmd.Path, serverUID, cmd.ExternalProcessID})
+// Message moved to the dead letter directory, e is nil when the resource is gone
+func deadLetter(m *spool.Message, e *HandlerEntry, reason error) {
+	extProcID := ""
+	if e != nil {
+		e.mu.Lock()
+		extProcID = e.ExternalProcessID
+		e.Spooled--
+		e.mu.Unlock()
 	}
-	if err := enc.Encode(resp); err != nil {
-		logThis(LogLine{"client:request:reply", "fail", err.Error(), cmdSockPath, serverUID, cmd.ExternalProcessID})
+	logThis(LogLine{"spool:dead-letter", "ok", fmt.Sprintf("message %s, %d attempts: %v", m.ID, m.Attempts, reason), m.Route, serverUID, extProcID})
+}
+
+/* The client got its 202 when the request was stored, a body file in the response has nobody
+ * to go to. Removed like writeResponse() would, if it's a file the server created. */
+func discardBodyFile(resp ResponseMsg, req RequestMsg, e *HandlerEntry) {
+	if resp.BodyFile == "" {
+		return
+	}
+	path := filepath.Clean(resp.BodyFile)
+	if !slices.Contains(req.tempFiles(), path) {
+		logThis(LogLine{"spool:deliver", "fail", "body file not created for the request", path, serverUID, e.ExternalProcessID})
 		return
 	}
+	if err := os.Remove(path); err != nil {
+		logThis(LogLine{"remove:file", "fail", err.Error(), path, serverUID, e.ExternalProcessID})
+	}
 }
 
-func decreaseResourceLifetime(ctx context.Context, mux *DynamicMux) {
-	ticker := time.NewTicker(time.Second)
+// ---------------- TLS ----------------
+
+// Load certificate, key and client CA files again on SIGHUP
+func reloadCertificates(ctx context.Context, certs *tlsconfig.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 	for {
 		select {
 		case <-ctx.Done():
-			ticker.Stop()
-			logThis(LogLine{"ticker:stop", "ok", "context done", "", serverUID, ""})
 			return
 
-		case <-ticker.C:
-			for k, v := range mux.handlers {
-				v.mu.Lock()
-				if v.Handled || v.Handling || v.Timeout <= 0 || k == "/ping" { // /ping runs forever
-					v.mu.Unlock()
-					continue
-				}
-
-				v.Timeout--
-				v.mu.Unlock()
+		case <-hup:
+			if err := certs.Reload(); err != nil {
+				logThis(LogLine{"tls:reload", "fail", err.Error(), tlsCertFile, serverUID, ""})
+				continue
 			}
+			logThis(LogLine{"tls:reload", "ok", "sighup", tlsCertFile, serverUID, ""})
 		}
 	}
 }
 
-// ---------------- Housekeeping ----------------
+// ---------------- Control ----------------
 
-func housekeeping(parent context.Context, cancel context.CancelFunc, mux *DynamicMux) {
-	// Give time to register
-	time.Sleep(3 * time.Second)
-	logThis(LogLine{"housekeep", "start", "", "", serverUID, ""})
-	ticker := time.NewTicker(10 * time.Millisecond)
+const controlUsage = "usage: http-server ctl [--command-socket FILE] [--command-secret-file FILE] list | inspect PATH"
+
+/* Send a command to a running server and print its reply, returns the exit status.
+ * Flags may come before or after the control command, server flags set their defaults. */
+func control(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.StringVar(&cmdSockPath, "command-socket", cmdSockPath, "Command socket file of the running server")
+	fs.StringVar(&cmdSecretFile, "command-secret-file", cmdSecretFile, "File with the shared secret command messages must carry")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), controlUsage)
+		fs.PrintDefaults()
+	}
+	var words []string
 	for {
-		select {
-		case <-parent.Done():
-			os.Remove(cmdSockPath) // Remove command socket file
-			logThis(LogLine{"shutdown", "ok", "context done", "func housekeeping()", serverUID, ""})
-			return
+		if err := fs.Parse(args); err != nil {
+			return 2
+		} else if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
 
-		case <-ticker.C:
-			mux.mu.Lock()
-			for k, v := range mux.handlers {
-				if k == "/ping" || v.Handling {
-					continue
-				}
+	var cmd Command
+	switch {
+	case len(words) == 1 && words[0] == "list":
+		cmd.Command = "list"
+	case len(words) == 2 && words[0] == "inspect":
+		cmd.Command = "inspect"
+		cmd.Path = words[1]
+	default:
+		fmt.Fprintln(os.Stderr, controlUsage)
+		return 2
+	}
+	if _, err := commandSocketAccess(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
 
-				if (!v.Enabled && v.Handled) || v.Timeout <= 0 {
-					reason := ""
-					if !v.Enabled && v.Handled {
-						reason = "handled"
-					} else {
-						reason = "timeout"
-					}
-
-					_, err := os.Stat(v.SocketFile)
-					if err == nil {
-						os.Remove(v.SocketFile)
-						logThis(LogLine{"remove:file", "ok", reason, v.SocketFile, serverUID, v.ExternalProcessID})
-					}
-
-					tempUID := v.ExternalProcessID
-					delete(mux.handlers, k)
-					logThis(LogLine{"remove:resource", "ok", reason, k, serverUID, tempUID})
-				}
-			}
-			mux.mu.Unlock()
-			remaining := len(mux.handlers) - 1 // -1 is /ping (this resource always exists)
-			if remaining == 0 {
-				ticker.Stop()
-				logThis(LogLine{"shutdown", "ok", "no resources available", "", serverUID, ""})
-				status = "shutdown"
-				cancel()
-			}
+	cmd.Secret = string(commandSecret)
+	conn, err := net.DialTimeout("unix", cmdSockPath, 5*time.Second)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	var reply CommandReply
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&reply); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if !reply.Ok {
+		fmt.Fprintln(os.Stderr, reply.Error)
+		return 1
+	}
+
+	if cmd.Command == "inspect" {
+		out, _ := json.MarshalIndent(reply.Resources[0], "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tOWNER\tMETHODS\tMODE\tTIMEOUT\tSTATE\tQUEUED\tHITS\tRELAYED\tACCEPTED")
+	for _, ri := range reply.Resources {
+		state := "enabled"
+		if ri.Handling {
+			state = "handling"
+		} else if ri.Handled {
+			state = "handled"
+		} else if !ri.Enabled {
+			state = "disabled"
 		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%d\t%d\t%d\t%d\n",
+			ri.Path, ri.ExternalProcessID, strings.Join(ri.AllowedMethods, ","), ri.Mode,
+			ri.Timeout, state, ri.Queued, ri.Hits, ri.Relayed, ri.Accepted)
 	}
+	tw.Flush()
+	return 0
 }
 
 // ---------------- Main ----------------
@@ -690,22 +3020,241 @@ var serverUID string
 var timeoutReadExtProc int
 var help bool
 var maxBodySize int64
+var spillThreshold int64
 var status string
+var tlsCertFile string
+var tlsKeyFile string
+var tlsClientCAFile string
+var cmdSockMode string
+var cmdAllowUIDs string
+var cmdAllowGIDs string
+var cmdSecretFile string
+var cmdPolicy peercred.Policy
+var commandSecret []byte
+var controlAddr string
+var controlTokenFile string
+var drainPoll time.Duration
+var serverMode string
+var idleShutdown time.Duration
+var drainTimeout time.Duration
+var printConfig bool
+var registryFile string
+
+/* Defaults overridden by the configuration file (--config or FLOWS_HTTP_CONFIG)
+ * and the environment. Command line flags are applied later, by flag.Parse() */
+func loadConfig(args []string) (*config.Config, error) {
+	path := os.Getenv(config.EnvPrefix + "CONFIG")
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			path = value
+		} else if i+1 < len(args) {
+			path = args[i+1]
+		}
+	}
+
+	cfg := config.Default()
+	if path != "" {
+		var err error
+		if cfg, err = config.Load(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Settings the server reads from globals
+func applyConfig(cfg *config.Config) {
+	serverUID = cfg.ServerUID
+	httpAddr = cfg.Listener.Address
+	cmdSockPath = cfg.Listener.CommandSocket
+	cmdSockMode = cfg.Listener.CommandSocketMode
+	controlAddr = cfg.Listener.ControlAddress
+	timeoutReadExtProc = cfg.Timeouts.ReadExternalProcess
+	drainPoll = cfg.Timeouts.DrainPoll.Duration
+	serverMode = cfg.Mode
+	idleShutdown = cfg.Timeouts.IdleShutdown.Duration
+	drainTimeout = cfg.Timeouts.Drain.Duration
+	maxBodySize = cfg.Limits.MaxBodySize
+	spillThreshold = cfg.Limits.SpillThreshold
+	tlsCertFile = cfg.Security.TLSCert
+	tlsKeyFile = cfg.Security.TLSKey
+	tlsClientCAFile = cfg.Security.TLSClientCA
+	cmdAllowUIDs = cfg.Security.CommandAllowUID
+	cmdAllowGIDs = cfg.Security.CommandAllowGID
+	cmdSecretFile = cfg.Security.CommandSecretFile
+	controlTokenFile = cfg.Security.ControlTokenFile
+	registryFile = cfg.Registry.File
+}
+
+// Comma separated list of uids or gids
+func parseIDs(s string) ([]uint32, error) {
+	var ids []uint32
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid id: " + v)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// Command socket access: file mode, peer policy and shared secret
+func commandSocketAccess() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(cmdSockMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.New("invalid command-socket-mode: " + cmdSockMode)
+	}
+	if cmdPolicy.UIDs, err = parseIDs(cmdAllowUIDs); err != nil {
+		return 0, err
+	}
+	if cmdPolicy.GIDs, err = parseIDs(cmdAllowGIDs); err != nil {
+		return 0, err
+	}
+	cmdPolicy.DefaultUID = uint32(os.Getuid())
+
+	if cmdSecretFile != "" {
+		b, err := os.ReadFile(cmdSecretFile)
+		if err != nil {
+			return 0, err
+		}
+		commandSecret = bytes.TrimSpace(b)
+		if len(commandSecret) == 0 {
+			return 0, errors.New("empty command secret file: " + cmdSecretFile)
+		}
+	}
+	return os.FileMode(mode), nil
+}
 
 func main() {
-	maxBodySize = int64(16 << 20) // 16 MB;
-	tempDir := os.TempDir()
+	os.Exit(run())
+}
 
-	flag.StringVar(&httpAddr, "address", "0.0.0.0:9090", "Server listens on this address for HTTP requests")
-	flag.StringVar(&cmdSockPath, "command-socket", tempDir+"/server.cmd.sock", "Socket file external processes must use to register resources")
-	flag.StringVar(&serverUID, "server-uid", "", "Server instance unique identifier (no default, mandatory)")
-	flag.IntVar(&timeoutReadExtProc, "timeout-read-external-process", 30, "How long (in seconds) to wait for external process write")
+// Server (or control mode) exit code, deferred closes run before the process exits
+func run() int {
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
 
+	// Flag defaults are the configuration file and environment settings
+	flag.String("config", "", "Configuration file (.yaml, .yml, .json or .toml), or set "+config.EnvPrefix+"CONFIG")
+	flag.StringVar(&cfg.Listener.Address, "address", cfg.Listener.Address, "Server listens on this address for HTTP requests")
+	flag.StringVar(&cfg.Listener.CommandSocket, "command-socket", cfg.Listener.CommandSocket, "Socket file external processes must use to register resources")
+	flag.StringVar(&cfg.ServerUID, "server-uid", cfg.ServerUID, "Server instance unique identifier (no default, mandatory)")
+	flag.IntVar(&cfg.Timeouts.ReadExternalProcess, "timeout-read-external-process", cfg.Timeouts.ReadExternalProcess, "How long (in seconds) to wait for external process write")
+	flag.StringVar(&cfg.Mode, "mode", cfg.Mode, "ephemeral: shut down when idle (no resources) for idle-shutdown, daemon: run until stopped")
+	flag.DurationVar(&cfg.Timeouts.IdleShutdown.Duration, "idle-shutdown", cfg.Timeouts.IdleShutdown.Duration, "Ephemeral mode, how long without resources before shutting down (also at startup)")
+	flag.DurationVar(&cfg.Timeouts.Drain.Duration, "drain-timeout", cfg.Timeouts.Drain.Duration, "On SIGINT/SIGTERM, how long to wait for requests in flight")
+	flag.DurationVar(&cfg.Timeouts.DrainPoll.Duration, "drain-poll", cfg.Timeouts.DrainPoll.Duration, "While draining, how often to check for requests still in flight")
+	flag.Int64Var(&cfg.Limits.MaxBodySize, "max-body-size", cfg.Limits.MaxBodySize, "Maximum request body size (in bytes), resources may set a lower limit")
+	flag.Int64Var(&cfg.Limits.SpillThreshold, "spill-threshold", cfg.Limits.SpillThreshold, "Request bodies larger than this (in bytes) are written to a file for the external process")
+	flag.StringVar(&cfg.Logging.File, "log-file", cfg.Logging.File, "Append log lines to this file instead of standard error")
+	flag.StringVar(&cfg.Security.TLSCert, "tls-cert", cfg.Security.TLSCert, "TLS certificate file (PEM), enables HTTPS")
+	flag.StringVar(&cfg.Security.TLSKey, "tls-key", cfg.Security.TLSKey, "TLS private key file (PEM)")
+	flag.StringVar(&cfg.Security.TLSClientCA, "tls-client-ca", cfg.Security.TLSClientCA, "CA certificates file (PEM) to verify client certificates, enables mutual TLS")
+
+	flag.StringVar(&cfg.Listener.CommandSocketMode, "command-socket-mode", cfg.Listener.CommandSocketMode, "Command socket file mode (octal)")
+	flag.StringVar(&cfg.Security.CommandAllowUID, "command-allow-uid", cfg.Security.CommandAllowUID, "Comma separated uids allowed to use the command socket (default: the server's uid)")
+	flag.StringVar(&cfg.Security.CommandAllowGID, "command-allow-gid", cfg.Security.CommandAllowGID, "Comma separated gids allowed to use the command socket")
+	flag.StringVar(&cfg.Security.CommandSecretFile, "command-secret-file", cfg.Security.CommandSecretFile, "File with the shared secret command messages must carry (optional)")
+	flag.StringVar(&cfg.Listener.ControlAddress, "control-address", cfg.Listener.ControlAddress, "Control API listens on this address (optional, disabled by default)")
+	flag.StringVar(&cfg.Security.ControlTokenFile, "control-token-file", cfg.Security.ControlTokenFile, "File with the control API bearer token (mandatory with control-address)")
+	flag.StringVar(&cfg.Registry.File, "registry-file", cfg.Registry.File, "Journal of registered resources, restored at startup (optional)")
+	flag.StringVar(&cfg.Spool.Dir, "spool-dir", cfg.Spool.Dir, "Directory for requests stored while their external process is unreachable (optional)")
+	flag.StringVar(&cfg.Spool.DeadLetterDir, "dead-letter-dir", cfg.Spool.DeadLetterDir, "Directory for stored requests not delivered after spool-max-attempts (default: spool-dir/dead-letter)")
+	flag.IntVar(&cfg.Spool.MaxAttempts, "spool-max-attempts", cfg.Spool.MaxAttempts, "Delivery attempts of a stored request, including the first one")
+	flag.DurationVar(&cfg.Spool.Backoff.Duration, "spool-backoff", cfg.Spool.Backoff.Duration, "Wait after the first failed delivery attempt, doubled after each one")
+	flag.DurationVar(&cfg.Spool.MaxBackoff.Duration, "spool-max-backoff", cfg.Spool.MaxBackoff.Duration, "Longest wait between delivery attempts")
+
+	flag.BoolVar(&printConfig, "print-config", false, "Print the effective configuration and exit")
 	flag.BoolVar(&help, "help", false, "Show this help")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nEnvironment variables (override the configuration file):")
+		for _, name := range config.EnvNames() {
+			fmt.Fprintln(flag.CommandLine.Output(), "  "+name)
+		}
+	}
 	flag.Parse()
-	if help || serverUID == "" {
+	applyConfig(cfg)
+	if help {
 		flag.Usage()
-		return
+		return 0
+	}
+	if flag.Arg(0) == "ctl" {
+		return control(flag.Args()[1:])
+	}
+	if printConfig {
+		fmt.Print(cfg.String())
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:\n"+err.Error())
+		return 2
+	} else if printConfig {
+		return 0
+	}
+	sockMode, err := commandSocketAccess()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	if cfg.Logging.File != "" {
+		f, err := os.OpenFile(cfg.Logging.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	var controlToken *auth.Options
+	if controlAddr != "" {
+		b, err := os.ReadFile(controlTokenFile)
+		if err != nil || len(bytes.TrimSpace(b)) == 0 {
+			fmt.Fprintln(os.Stderr, "control-address requires a non empty control-token-file")
+			return 2
+		}
+		controlToken = &auth.Options{Scheme: auth.Bearer, Tokens: []string{string(bytes.TrimSpace(b))}}
+	}
+
+	var restored []registry.Entry
+	if registryFile != "" {
+		if journal, restored, err = registry.Open(registryFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+		defer journal.Close()
+	}
+	if cfg.Spool.Dir != "" {
+		spooler, err = spool.Open(spool.Options{
+			Dir:           cfg.Spool.Dir,
+			DeadLetterDir: cfg.Spool.DeadLetterDir,
+			MaxAttempts:   cfg.Spool.MaxAttempts,
+			Backoff:       cfg.Spool.Backoff.Duration,
+			MaxBackoff:    cfg.Spool.MaxBackoff.Duration,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
 	}
 
 	status = "starting"
@@ -714,20 +3263,45 @@ func main() {
 	}
 	// Run server for 1 year
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	// The server and handler(s) entry(ies)
 	mux := NewMux()
 	httpServer := &http.Server{
 		Addr:    httpAddr,
 		Handler: mux,
 	}
+	var certs *tlsconfig.Reloader
+	if tlsCertFile != "" || tlsKeyFile != "" || tlsClientCAFile != "" {
+		var err error
+		certs, err = tlsconfig.New(tlsCertFile, tlsKeyFile, tlsClientCAFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tls: "+err.Error())
+			return 2
+		}
+		httpServer.TLSConfig = certs.Config()
+		go reloadCertificates(ctx, certs)
+	}
 	// Listen for commands
-	listener, err := net.Listen("unix", cmdSockPath)
+	listener, err := listenUnix(cmdSockPath, sockMode)
 	if err != nil {
 		panic(err.Error())
 	} else {
 		logThis(LogLine{"net:listen", "ok", "", cmdSockPath, serverUID, ""})
 	}
 
+	// Resources of the previous server instance, before new commands are accepted
+	restore(mux, restored)
+	if spooler != nil {
+		// Requests stored by the previous server instance
+		mux.mu.Lock()
+		for _, m := range spooler.Pending() {
+			if e := mux.handlers[m.Route]; e != nil {
+				e.Spooled++
+			}
+		}
+		mux.mu.Unlock()
+		go deliverSpooled(ctx, mux)
+	}
 	go func() {
 		listenForClient(listener, ctx, mux)
 	}()
@@ -737,7 +3311,12 @@ func main() {
 	go func() {
 		logThis(LogLine{"http:listen", "ok", "", httpServer.Addr, serverUID, ""})
 		status = "listening"
-		err := httpServer.ListenAndServe()
+		var err error
+		if certs != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
 		if err == http.ErrServerClosed {
 			logThis(LogLine{"http:shutdown", "ok", "shutdown", httpServer.Addr, serverUID, ""})
 		} else {
@@ -745,17 +3324,39 @@ func main() {
 		}
 	}()
 
+	var controlServer *http.Server
+	if controlToken != nil {
+		controlServer = &http.Server{
+			Addr:    controlAddr,
+			Handler: controlAPI(mux, controlToken),
+		}
+		go func() {
+			logThis(LogLine{"control:listen", "ok", "", controlServer.Addr, serverUID, ""})
+			var err error
+			if certs != nil {
+				controlServer.TLSConfig = certs.Config()
+				err = controlServer.ListenAndServeTLS("", "")
+			} else {
+				err = controlServer.ListenAndServe()
+			}
+			if err == http.ErrServerClosed {
+				logThis(LogLine{"control:shutdown", "ok", "shutdown", controlServer.Addr, serverUID, ""})
+			} else {
+				logThis(LogLine{"control:shutdown", "fail", err.Error(), controlServer.Addr, serverUID, ""})
+			}
+		}()
+	}
+
 	go func() {
 		<-ctx.Done()
 		newCtx, newCancel := context.WithTimeout(context.Background(), time.Duration(timeoutReadExtProc)*time.Second)
+		if controlServer != nil {
+			controlServer.Shutdown(newCtx)
+		}
 		httpServer.Shutdown(newCtx)
 		newCancel()
 	}()
 
-	go func() {
-		decreaseResourceLifetime(ctx, mux)
-	}()
-
 	go func() {
 		housekeeping(ctx, cancel, mux)
 	}()
@@ -763,12 +3364,27 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	select {
-	case <-sig:
+	case s := <-sig:
+		drained := drain(mux, s.String(), drainTimeout)
 		logThis(LogLine{"context:cancel", "ok", "os interrupt", "", serverUID, ""})
 		status = "shutdown"
 		cancel()
 
+		// Nothing is in flight anymore (unless the drain timed out), close listeners and idle connections
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+		defer shutdownCancel()
+		if controlServer != nil {
+			controlServer.Shutdown(shutdownCtx)
+		}
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			drained = false
+		}
+		os.Remove(cmdSockPath)
+		if !drained {
+			return 1
+		}
+
 	case <-ctx.Done():
-		return
 	}
+	return 0
 }
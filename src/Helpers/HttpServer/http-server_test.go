@@ -0,0 +1,1471 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	auth "flows.local/http-server/auth"
+	compress "flows.local/http-server/compress"
+	config "flows.local/http-server/config"
+	peercred "flows.local/http-server/peercred"
+	registry "flows.local/http-server/registry"
+	signature "flows.local/http-server/signature"
+	spool "flows.local/http-server/spool"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	timeoutReadExtProc = 5
+	maxBodySize = 1 << 20
+	spillThreshold = 64 << 10
+	os.Exit(m.Run())
+}
+
+// External process listening on a unix socket, answers every request message with reply
+func fakeHandler(t *testing.T, reply func(RequestMsg) ResponseMsg) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "h.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer(t, l, reply)
+	return sock
+}
+
+// Same as fakeHandler(), on a TCP port
+func fakeTCPHandler(t *testing.T, reply func(RequestMsg) ResponseMsg) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer(t, l, reply)
+	return tcpPrefix + l.Addr().String()
+}
+
+func answer(t *testing.T, l net.Listener, reply func(RequestMsg) ResponseMsg) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var req RequestMsg
+				if json.NewDecoder(conn).Decode(&req) != nil {
+					return
+				}
+				json.NewEncoder(conn).Encode(reply(req))
+			}()
+		}
+	}()
+}
+
+func mustRegister(t *testing.T, mux *DynamicMux, cmd Command) CommandReply {
+	t.Helper()
+	cmd.Command = "register"
+	if cmd.ExternalProcessID == "" {
+		cmd.ExternalProcessID = "test"
+	}
+	reply := register(cmd, mux)
+	if !reply.Ok {
+		t.Fatalf("register %s: %s", cmd.Path, reply.Error)
+	}
+	return reply
+}
+
+func serve(mux *DynamicMux, method, path, token string) int {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestOneTimeTokenConcurrentUse(t *testing.T) {
+	answer := make(chan struct{})
+	sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+		<-answer
+		return ResponseMsg{RequestID: req.RequestID, Ok: true}
+	})
+	mux := NewMux()
+	reg := mustRegister(t, mux, Command{Path: "/pay", SocketFile: sock, Timeout: 60, QueueDepth: 3, Auth: &auth.Options{Scheme: auth.OneTime}})
+
+	codes := make(chan int, 3)
+	for range 3 {
+		go func() { codes <- serve(mux, http.MethodGet, "/pay", reg.Token) }()
+	}
+	// The request holding the token waits for the external process, the others are refused at once
+	for range 2 {
+		if code := <-codes; code != http.StatusUnauthorized {
+			t.Errorf("concurrent request status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	}
+	close(answer)
+	if code := <-codes; code != http.StatusAccepted {
+		t.Errorf("first request status = %d, want %d", code, http.StatusAccepted)
+	}
+	if accepted := mux.handlers["/pay"].Accepted; accepted != 1 {
+		t.Errorf("Accepted = %d, want 1", accepted)
+	}
+}
+
+func TestOneTimeTokenRestored(t *testing.T) {
+	answers := make(chan bool, 2)
+	answers <- false
+	answers <- true
+	sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+		return ResponseMsg{RequestID: req.RequestID, Ok: <-answers}
+	})
+	mux := NewMux()
+	reg := mustRegister(t, mux, Command{Path: "/pay", SocketFile: sock, Timeout: 60, Mode: modePersistent, Auth: &auth.Options{Scheme: auth.OneTime}})
+
+	// Rejected by the external process, the token can be used again
+	want := []int{http.StatusBadRequest, http.StatusAccepted, http.StatusUnauthorized}
+	for i, status := range want {
+		if code := serve(mux, http.MethodGet, "/pay", reg.Token); code != status {
+			t.Errorf("request %d status = %d, want %d", i+1, code, status)
+		}
+	}
+}
+
+func TestInFlightAfterQueuedNotFound(t *testing.T) {
+	answer := make(chan struct{})
+	sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+		<-answer
+		return ResponseMsg{RequestID: req.RequestID, Ok: true}
+	})
+	mux := NewMux()
+	mustRegister(t, mux, Command{Path: "/once", SocketFile: sock, Timeout: 60, QueueDepth: 2})
+	e := mux.handlers["/once"]
+
+	codes := make(chan int, 3)
+	for range 3 {
+		go func() { codes <- serve(mux, http.MethodGet, "/once", "") }()
+	}
+	waitFor(t, func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.Queued == 3
+	})
+	// First request uses the only shot, the queued ones find the resource disabled
+	close(answer)
+	count := map[int]int{}
+	for range 3 {
+		count[<-codes]++
+	}
+	if count[http.StatusAccepted] != 1 || count[http.StatusNotFound] != 2 {
+		t.Errorf("status counts = %v, want one 202 and two 404", count)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.InFlight != 0 || e.Queued != 0 || e.Handling {
+		t.Errorf("InFlight = %d, Queued = %d, Handling = %v, want 0, 0, false", e.InFlight, e.Queued, e.Handling)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for range 200 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestBusyResourceCheckedAgain(t *testing.T) {
+	answer := make(chan struct{})
+	sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+		<-answer
+		return ResponseMsg{RequestID: req.RequestID, Ok: true}
+	})
+	mux := NewMux()
+	mustRegister(t, mux, Command{Path: "/hb", SocketFile: sock, Mode: modePersistent, HeartbeatInterval: 1})
+	e := mux.handlers["/hb"]
+
+	code := make(chan int, 1)
+	go func() { code <- serve(mux, http.MethodGet, "/hb", "") }()
+	waitFor(t, func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.Relayed == 1
+	})
+
+	// Heartbeat check is due while the request is in flight, the owner is alive
+	e.mu.Lock()
+	start := e.LastSeen
+	e.LastSeen = start.Add(2 * time.Second)
+	e.mu.Unlock()
+	mux.mu.Lock()
+	removeDue(mux, start.Add(4*time.Second))
+	mux.mu.Unlock()
+
+	close(answer)
+	<-code
+	// Owner stopped sending heartbeats
+	mux.mu.Lock()
+	removeDue(mux, start.Add(10*time.Second))
+	_, found := mux.handlers["/hb"]
+	mux.mu.Unlock()
+	if found {
+		t.Error("resource of a dead owner was not removed")
+	}
+}
+
+func TestSharedSocketFileKept(t *testing.T) {
+	sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+		return ResponseMsg{RequestID: req.RequestID, Ok: true}
+	})
+	mux := NewMux()
+	mustRegister(t, mux, Command{Path: "/first", SocketFile: sock, Timeout: 60})
+	mustRegister(t, mux, Command{Path: "/second", SocketFile: sock, Timeout: 60})
+
+	if code := serve(mux, http.MethodGet, "/first", ""); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", code, http.StatusAccepted)
+	}
+	mux.mu.Lock()
+	removeDue(mux, time.Now()) // Used resource is due at once
+	_, found := mux.handlers["/first"]
+	mux.mu.Unlock()
+	if found {
+		t.Fatal("used resource was not removed")
+	}
+	if code := serve(mux, http.MethodGet, "/second", ""); code != http.StatusAccepted {
+		t.Errorf("status after removal of /first = %d, want %d", code, http.StatusAccepted)
+	}
+}
+
+func TestRestoreKeepsSharedSocketFile(t *testing.T) {
+	dir := t.TempDir()
+	shared, own := filepath.Join(dir, "shared.sock"), filepath.Join(dir, "own.sock")
+	for _, f := range []string{shared, own} {
+		if err := os.WriteFile(f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := func(path, socketFile string, expiresAt time.Time) registry.Entry {
+		b, _ := json.Marshal(Command{Command: "register", Path: path, SocketFile: socketFile, ExternalProcessID: "test", Timeout: 60, Mode: modeSingle})
+		return registry.Entry{Path: path, Command: b, ExpiresAt: expiresAt.Unix()}
+	}
+	now := time.Now()
+	mux := NewMux()
+	// Sorted by path, expired entries come first
+	restore(mux, []registry.Entry{
+		entry("/a", shared, now.Add(-time.Minute)),
+		entry("/b", own, now.Add(-time.Minute)),
+		entry("/c", shared, now.Add(time.Minute)),
+	})
+
+	if _, found := mux.handlers["/c"]; !found || len(mux.handlers) != 1 {
+		t.Errorf("restored resources = %v, want /c only", slices.Collect(maps.Keys(mux.handlers)))
+	}
+	if _, err := os.Stat(shared); err != nil {
+		t.Errorf("socket file of a restored resource was removed: %v", err)
+	}
+	if _, err := os.Stat(own); err == nil {
+		t.Error("socket file of an expired resource was kept")
+	}
+}
+
+func TestResponseBodyFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		symlink    bool
+		forRequest bool // Created by the server for the request
+		status     int
+	}{
+		{"request file", false, true, http.StatusOK},
+		{"other file", false, false, http.StatusBadGateway},
+		{"request file symlink", true, true, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "body")
+			if err := os.WriteFile(target, []byte("hello"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			path := target
+			if tt.symlink {
+				path = filepath.Join(dir, "link")
+				if err := os.Symlink(target, path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var reqFiles []string
+			if tt.forRequest {
+				reqFiles = []string{path}
+			}
+
+			e := &HandlerEntry{SocketFile: "/tmp/h.sock"}
+			w := httptest.NewRecorder()
+			resp := ResponseMsg{Ok: true, HttpStatus: http.StatusOK, BodyFile: path}
+			writeResponse(w, httptest.NewRequest(http.MethodGet, "/", nil), resp, e, reqFiles)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			_, err := os.Stat(target)
+			if tt.status == http.StatusOK && (w.Body.String() != "hello" || err == nil) {
+				t.Errorf("body = %q, file removed %v, want the file content and its removal", w.Body.String(), err != nil)
+			} else if tt.status != http.StatusOK && err != nil {
+				t.Error("refused body file was removed")
+			}
+		})
+	}
+}
+
+func TestResponseFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		write  bool // External process writes the body to the response file and sends it back
+		status int
+		body   string
+	}{
+		{"used", true, http.StatusOK, "large body"},
+		{"not used", false, http.StatusAccepted, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make(chan string, 1)
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				files <- req.ResponseFile
+				if !tt.write {
+					return ResponseMsg{RequestID: req.RequestID, Ok: true}
+				}
+				os.WriteFile(req.ResponseFile, []byte(tt.body), 0600)
+				return ResponseMsg{RequestID: req.RequestID, Ok: true, HttpStatus: http.StatusOK, BodyFile: req.ResponseFile}
+			})
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/report", SocketFile: sock, Timeout: 60, ResponseFile: true})
+
+			r := httptest.NewRequest(http.MethodGet, "/report", nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body, tt.status, tt.body)
+			}
+			// Removed with the request, sent or not
+			if f := <-files; f == "" {
+				t.Error("no response file in the request message")
+			} else if _, err := os.Stat(f); err == nil {
+				t.Errorf("response file %s was kept", f)
+			}
+		})
+	}
+
+	reply := register(Command{Command: "register", Path: "/tcp", SocketFile: "tcp://127.0.0.1:9000", ExternalProcessID: "test", ResponseFile: true}, NewMux())
+	if reply.Ok {
+		t.Error("TCP handler registered with a response file")
+	}
+}
+
+func TestSignatureOfCompressedBody(t *testing.T) {
+	const payload = `{"event":"paid"}`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(payload))
+	zw.Close()
+	sign := func(b []byte) string {
+		m := hmac.New(sha256.New, []byte("s3cret"))
+		m.Write(b)
+		return hex.EncodeToString(m.Sum(nil))
+	}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		signed   []byte
+		status   int
+	}{
+		{"plain", []byte(payload), "", []byte(payload), http.StatusAccepted},
+		{"gzip signed as sent", gz.Bytes(), "gzip", gz.Bytes(), http.StatusAccepted},
+		{"gzip signed decompressed", gz.Bytes(), "gzip", []byte(payload), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies := make(chan any, 1)
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				bodies <- req.Body
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			verify := &signature.Options{Scheme: signature.HmacSha256, Secret: "s3cret", Header: "X-Signature"}
+			mustRegister(t, mux, Command{Path: "/hook", SocketFile: sock, Timeout: 60, AllowedMethods: []string{http.MethodPost}, Verify: verify})
+
+			r := httptest.NewRequest(http.MethodPost, "/hook", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("X-Signature", sign(tt.signed))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusAccepted {
+				// External process gets the decompressed body
+				if body := <-bodies; body != payload {
+					t.Errorf("relayed body = %v, want %s", body, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeNDJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		spill   int64 // Spill threshold, 0 => default
+		records []string
+		file    string // Body file content, "" => records in the message
+		err     string
+	}{
+		{"records", "{\"a\":1}\n[2]\n", 0, []string{`{"a":1}`, `[2]`}, "", ""},
+		{"blank lines", "\n{\"a\":1}\n\n  \n3\n", 0, []string{`{"a":1}`, `3`}, "", ""},
+		{"no trailing newline", "{\"a\":1}\n\"b\"", 0, []string{`{"a":1}`, `"b"`}, "", ""},
+		{"empty", "", 0, []string{}, "", ""},
+		{"invalid line", "{\"a\":1}\n{\"a\":\n3\n", 0, nil, "", "Invalid JSON in line 2"},
+		{"spilled", "{\"a\":1}\n\n[2]\n\"c\"", 10, nil, "{\"a\":1}\n[2]\n\"c\"\n", ""},
+		{"invalid line after spill", "{\"a\":1}\n[2]\n{", 5, nil, "", "Invalid JSON in line 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.spill > 0 {
+				defer func(old int64) { spillThreshold = old }(spillThreshold)
+				spillThreshold = tt.spill
+			}
+			var req RequestMsg
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			rm, err := decodeNDJSON(r, &req, &HandlerEntry{})
+
+			if tt.err != "" {
+				if err == nil || rm.Message != tt.err {
+					t.Fatalf("decodeNDJSON() = %q %v, want %q", rm.Message, err, tt.err)
+				}
+				if req.BodyFile != "" {
+					t.Errorf("body file %s set on failure", req.BodyFile)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if tt.file == "" {
+				if records, _ := req.Body.([]string); req.BodyFile != "" || !slices.Equal(records, tt.records) {
+					t.Errorf("body = %#v, file %q, want %#v", req.Body, req.BodyFile, tt.records)
+				}
+				return
+			}
+			defer os.Remove(req.BodyFile)
+			if b, err := os.ReadFile(req.BodyFile); err != nil || string(b) != tt.file || req.Body != nil {
+				t.Errorf("body file = %q %v, body %v, want %q", b, err, req.Body, tt.file)
+			}
+		})
+	}
+}
+
+func TestCommandSocketPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials (SO_PEERCRED) are read on linux only")
+	}
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	tests := []struct {
+		name   string
+		policy peercred.Policy
+		secret string // Server shared secret, the client sends "s3cret"
+		ok     bool
+	}{
+		{"server uid", peercred.Policy{DefaultUID: uid}, "", true},
+		{"other default uid", peercred.Policy{DefaultUID: uid + 1}, "", false},
+		{"listed uid", peercred.Policy{UIDs: []uint32{uid + 1, uid}, DefaultUID: uid + 1}, "", true},
+		{"listed gid", peercred.Policy{GIDs: []uint32{gid}, DefaultUID: uid + 1}, "", true},
+		{"not listed", peercred.Policy{UIDs: []uint32{uid + 1}, GIDs: []uint32{gid + 1}, DefaultUID: uid}, "", false},
+		{"allowed, same secret", peercred.Policy{DefaultUID: uid}, "s3cret", true},
+		{"allowed, other secret", peercred.Policy{DefaultUID: uid}, "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(p peercred.Policy, s []byte) { cmdPolicy, commandSecret = p, s }(cmdPolicy, commandSecret)
+			cmdPolicy, commandSecret = tt.policy, []byte(tt.secret)
+
+			sock := filepath.Join(t.TempDir(), "cmd.sock")
+			l, err := listenUnix(sock, 0660)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0660 {
+				t.Fatalf("socket file mode = %v %v, want 0660", fi.Mode().Perm(), err)
+			}
+			mux := NewMux()
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					handleClient(conn, mux)
+				}
+			}()
+
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			json.NewEncoder(conn).Encode(Command{Command: "list", Secret: "s3cret"}) // Refused peers may be gone before this
+			var reply CommandReply
+			if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Ok != tt.ok || (!tt.ok && reply.Error != "permission denied") {
+				t.Errorf("reply = %+v, want ok %v", reply, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOwnedBy(t *testing.T) {
+	verified := peercred.Cred{PID: 100, UID: 1000}
+	tests := []struct {
+		name  string
+		entry *HandlerEntry
+		cmd   Command
+		owned bool
+	}{
+		{"same peer uid", &HandlerEntry{ExternalProcessID: "A", Via: viaCommandSocket, PeerPID: 100, PeerUID: 1000},
+			Command{ExternalProcessID: "A", via: viaCommandSocket, peer: peercred.Cred{PID: 200, UID: 1000}}, true},
+		{"root peer", &HandlerEntry{ExternalProcessID: "A", Via: viaCommandSocket, PeerPID: 100, PeerUID: 1000},
+			Command{ExternalProcessID: "A", via: viaCommandSocket, peer: peercred.Cred{PID: 200, UID: 0}}, true},
+		{"other peer uid", &HandlerEntry{ExternalProcessID: "A", Via: viaCommandSocket, PeerPID: 100, PeerUID: 1000},
+			Command{ExternalProcessID: "A", via: viaCommandSocket, peer: peercred.Cred{PID: 200, UID: 1001}}, false},
+		{"other process id", &HandlerEntry{ExternalProcessID: "A", Via: viaCommandSocket, PeerPID: 100, PeerUID: 1000},
+			Command{ExternalProcessID: "B", via: viaCommandSocket, peer: verified}, false},
+		{"no peer credentials", &HandlerEntry{ExternalProcessID: "A", Via: viaCommandSocket, PeerPID: 100, PeerUID: 1000},
+			Command{ExternalProcessID: "A", via: viaCommandSocket}, false},
+		{"control API on verified owner", &HandlerEntry{ExternalProcessID: "A", Via: viaCommandSocket, PeerPID: 100, PeerUID: 1000},
+			Command{ExternalProcessID: "A", via: viaControlAPI}, false},
+		{"control API on command socket owner", &HandlerEntry{ExternalProcessID: "A", Via: viaCommandSocket},
+			Command{ExternalProcessID: "A", via: viaControlAPI}, false},
+		{"control API", &HandlerEntry{ExternalProcessID: "A", Via: viaControlAPI},
+			Command{ExternalProcessID: "A", via: viaControlAPI}, true},
+		{"command socket on control API owner", &HandlerEntry{ExternalProcessID: "A", Via: viaControlAPI},
+			Command{ExternalProcessID: "A", via: viaCommandSocket, peer: verified}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if owned := tt.entry.ownedBy(tt.cmd); owned != tt.owned {
+				t.Errorf("ownedBy() = %v, want %v", owned, tt.owned)
+			}
+		})
+	}
+}
+
+func TestTCPHandlerInlineBody(t *testing.T) {
+	defer func(old int64) { spillThreshold = old }(spillThreshold)
+	spillThreshold = 16
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("name", "report")
+	fw, _ := mw.CreateFormFile("upload", "data.bin")
+	fw.Write(binary)
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		limit       int64                 // Resource body size limit, 0 => server limit
+		check       func(RequestMsg) bool // Relayed message has the whole body, nil => refused
+	}{
+		{"json", "application/json", []byte(`{"data":"0123456789abcdef0123"}`), 0, func(req RequestMsg) bool {
+			return req.Body == `{"data":"0123456789abcdef0123"}`
+		}},
+		{"binary", "application/octet-stream", binary, 0, func(req RequestMsg) bool {
+			b, _ := base64.StdEncoding.DecodeString(req.Body.(string))
+			return req.BodyEncoding == "base64" && bytes.Equal(b, binary)
+		}},
+		{"ndjson", "application/x-ndjson", []byte("{\"a\":\"0123456789\"}\n{\"b\":\"0123456789\"}\n"), 0, func(req RequestMsg) bool {
+			records, _ := req.Body.([]any)
+			return len(records) == 2 && records[1] == `{"b":"0123456789"}`
+		}},
+		{"multipart", mw.FormDataContentType(), form.Bytes(), 0, func(req RequestMsg) bool {
+			return len(req.Files) == 1 && req.Files[0].Path == "" && bytes.Equal(req.Files[0].Content, binary) && req.Files[0].Size == 256
+		}},
+		{"binary over the limit", "application/octet-stream", binary, 255, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayed := make(chan RequestMsg, 1)
+			sock := fakeTCPHandler(t, func(req RequestMsg) ResponseMsg {
+				relayed <- req
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/up", SocketFile: sock, Timeout: 60, AllowedMethods: []string{http.MethodPost}, ContentTypes: []string{strings.Split(tt.contentType, ";")[0]}, MaxBodySize: tt.limit})
+
+			r := httptest.NewRequest(http.MethodPost, "/up", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if tt.check == nil {
+				if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "max size") {
+					t.Errorf("status = %d %s, want %d", w.Code, w.Body, http.StatusRequestEntityTooLarge)
+				}
+				return
+			} else if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusAccepted)
+			}
+			req := <-relayed
+			if req.BodyFile != "" || !tt.check(req) {
+				t.Errorf("relayed body = %v, file %q, files %+v, want the body in the message", req.Body, req.BodyFile, req.Files)
+			}
+		})
+	}
+}
+
+func TestSpoolDeliver(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource bool
+		expired  bool
+		bodyFile string // Sent back by the external process: request, other or none
+		dead     bool
+	}{
+		{"delivered", true, false, "", false},
+		{"resource gone", false, false, "", true},
+		{"resource expired", true, true, "", true},
+		{"request body file sent back", true, false, "request", false},
+		{"other body file sent back", true, false, "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var err error
+			spooler, err = spool.Open(spool.Options{Dir: dir, MaxAttempts: 10, Backoff: time.Millisecond, MaxBackoff: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { spooler = nil })
+
+			other := filepath.Join(t.TempDir(), "other")
+			os.WriteFile(other, []byte("other"), 0600)
+			mux := NewMux()
+			if tt.resource {
+				sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+					resp := ResponseMsg{Ok: true, HttpStatus: http.StatusOK}
+					switch tt.bodyFile {
+					case "request":
+						resp.BodyFile = req.BodyFile
+					case "other":
+						resp.BodyFile = other
+					}
+					return resp
+				})
+				mustRegister(t, mux, Command{Path: "/r", SocketFile: sock, Timeout: 60, Spool: true})
+				e := mux.handlers["/r"]
+				e.Spooled++
+				if tt.expired {
+					e.Deadline = time.Now().Add(-time.Second)
+				}
+			}
+
+			body := filepath.Join(t.TempDir(), "body")
+			os.WriteFile(body, []byte("body"), 0600)
+			kept, err := spooler.Keep([]string{body})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := spooler.Put("/r", RequestMsg{RequestID: "1", BodyFile: kept[0]}, kept, errors.New("dial"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			spooler.Due(m.NextAttempt)
+			deliver(mux, m)
+
+			_, err = os.Stat(filepath.Join(dir, "dead-letter", m.ID+".json"))
+			if dead := err == nil; dead != tt.dead || (dead && m.Attempts != 2) {
+				t.Errorf("dead letter = %v after %d attempts, want %v at once", dead, m.Attempts, tt.dead)
+			}
+			if e := mux.handlers["/r"]; e != nil && e.Spooled != 0 {
+				t.Errorf("spooled = %d, want 0", e.Spooled)
+			}
+			_, err = os.Stat(kept[0])
+			if removed := err != nil; removed != (tt.bodyFile == "request" || tt.dead) {
+				t.Errorf("request body file removed = %v", removed)
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Error("other body file was removed")
+			}
+		})
+	}
+}
+
+func TestModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		shots   int
+		err     string
+		replies []bool // Ok of the external process response, per request
+		want    []int
+	}{
+		{"default is single", "", 0, "", []bool{true, true}, []int{http.StatusAccepted, http.StatusNotFound}},
+		{"single after rejection", modeSingle, 0, "", []bool{false, true, true}, []int{http.StatusBadRequest, http.StatusAccepted, http.StatusNotFound}},
+		{"multi", modeMulti, 2, "", []bool{true, false, true, true}, []int{http.StatusAccepted, http.StatusBadRequest, http.StatusAccepted, http.StatusNotFound}},
+		{"persistent", modePersistent, 0, "", []bool{true, true, true}, []int{http.StatusAccepted, http.StatusAccepted, http.StatusAccepted}},
+		{"multi without shots", modeMulti, 0, "invalid shots", nil, nil},
+		{"unknown mode", "forever", 0, "invalid mode", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies := make(chan bool, len(tt.replies))
+			for _, ok := range tt.replies {
+				replies <- ok
+			}
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				return ResponseMsg{RequestID: req.RequestID, Ok: <-replies}
+			})
+			mux := NewMux()
+			reply := register(Command{Command: "register", Path: "/m", SocketFile: sock, ExternalProcessID: "test", Timeout: 60, Mode: tt.mode, Shots: tt.shots}, mux)
+			if reply.Error != tt.err {
+				t.Fatalf("register error = %q, want %q", reply.Error, tt.err)
+			}
+			for i, status := range tt.want {
+				if code := serve(mux, http.MethodGet, "/m", ""); code != status {
+					t.Errorf("request %d status = %d, want %d", i+1, code, status)
+				}
+			}
+		})
+	}
+}
+
+func TestQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		queueDepth int
+		queueWait  int
+		requests   int
+		rejected   int // Answered 503 while the external process holds the first request
+		retryAfter string
+	}{
+		{"no queue", 0, 0, 2, 1, "1"},
+		{"queued", 2, 0, 3, 0, ""},
+		{"queue full", 1, 5, 3, 1, "5"},
+		{"wait expired", 1, 1, 2, 1, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := make(chan struct{})
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				<-answer
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/q", SocketFile: sock, Timeout: 60, Mode: modePersistent, QueueDepth: tt.queueDepth, QueueWait: tt.queueWait})
+
+			results := make(chan *httptest.ResponseRecorder, tt.requests)
+			for range tt.requests {
+				go func() {
+					w := httptest.NewRecorder()
+					mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/q", nil))
+					results <- w
+				}()
+			}
+			for range tt.rejected {
+				w := <-results
+				if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != tt.retryAfter {
+					t.Errorf("rejected status = %d, Retry-After %q, want %d, %q", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable, tt.retryAfter)
+				}
+			}
+			// Queued requests are relayed one at a time
+			close(answer)
+			for range tt.requests - tt.rejected {
+				if w := <-results; w.Code != http.StatusAccepted {
+					t.Errorf("queued status = %d, want %d", w.Code, http.StatusAccepted)
+				}
+			}
+		})
+	}
+}
+
+func TestGeneratePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		mode    string
+		timeout int
+		err     string
+		prefix  string
+		expires bool
+	}{
+		{"prefix", "/callbacks", "", 60, "", "/callbacks/", true},
+		{"prefix with trailing slash", "/callbacks/", "", 60, "", "/callbacks/", true},
+		{"no prefix", "", "", 60, "", "/", true},
+		{"never expires", "/callbacks", modePersistent, 0, "", "/callbacks/", false},
+		{"template prefix", "/orders/{id}", "", 60, "invalid path prefix", "", false},
+		{"wildcard prefix", "/callbacks/*", "", 60, "invalid path prefix", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			reply := register(Command{Command: "register", Path: tt.path, SocketFile: sock, ExternalProcessID: "test", Timeout: tt.timeout, Mode: tt.mode, GeneratePath: true}, mux)
+			if reply.Error != tt.err {
+				t.Fatalf("register error = %q, want %q", reply.Error, tt.err)
+			}
+			if tt.err != "" {
+				return
+			}
+
+			segment, found := strings.CutPrefix(reply.Path, tt.prefix)
+			if !found || len(segment) != 43 || strings.Contains(segment, "/") {
+				t.Errorf("path = %q, want %s followed by a random segment", reply.Path, tt.prefix)
+			}
+			if (reply.ExpiresAt != "") != tt.expires {
+				t.Errorf("expires at = %q, want set %v", reply.ExpiresAt, tt.expires)
+			}
+			if other := register(Command{Command: "register", Path: tt.path, SocketFile: sock, ExternalProcessID: "test", Timeout: 60, GeneratePath: true}, mux); other.Path == reply.Path {
+				t.Errorf("second register got the same path %q", other.Path)
+			}
+			if code := serve(mux, http.MethodGet, tt.prefix, ""); code != http.StatusNotFound {
+				t.Errorf("prefix status = %d, want %d", code, http.StatusNotFound)
+			}
+			if code := serve(mux, http.MethodGet, reply.Path, ""); code != http.StatusAccepted {
+				t.Errorf("generated path status = %d, want %d", code, http.StatusAccepted)
+			}
+		})
+	}
+}
+
+func TestQueryRelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		required []string
+		status   int
+		query    map[string][]string
+	}{
+		{"multi-valued", http.MethodGet, "/cb?a=1&a=2&b=", "", nil, http.StatusAccepted, map[string][]string{"a": {"1", "2"}, "b": {""}}},
+		{"without body", http.MethodDelete, "/cb?id=7", "", nil, http.StatusAccepted, map[string][]string{"id": {"7"}}},
+		{"with body", http.MethodPost, "/cb?x=1", `{"y":2}`, nil, http.StatusAccepted, map[string][]string{"x": {"1"}}},
+		{"invisible runes", http.MethodGet, "/cb?k%E2%80%8B=v%E2%80%8B", "", nil, http.StatusAccepted, map[string][]string{"k": {"v"}}},
+		{"no query", http.MethodGet, "/cb", "", nil, http.StatusAccepted, nil},
+		{"required keys", http.MethodGet, "/cb?state=s&code=c", "", []string{"state", "code"}, http.StatusAccepted, map[string][]string{"state": {"s"}, "code": {"c"}}},
+		{"required key missing", http.MethodGet, "/cb?code=c", "", []string{"state", "code"}, http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(chan map[string][]string, 1)
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				got <- req.Query
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/cb", SocketFile: sock, Timeout: 60, AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, RequiredQuery: tt.required})
+
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusAccepted {
+				return
+			}
+			if q := <-got; !reflect.DeepEqual(q, tt.query) {
+				t.Errorf("query = %v, want %v", q, tt.query)
+			}
+		})
+	}
+}
+
+func TestFormFields(t *testing.T) {
+	type upload struct{ field, filename, content string }
+	tests := []struct {
+		name      string
+		multipart bool
+		fields    [][2]string
+		uploads   []upload
+		body      map[string][]string
+	}{
+		{"urlencoded", false, [][2]string{{"a", "1"}, {"a", "2"}, {"b", "x"}}, nil, map[string][]string{"a": {"1", "2"}, "b": {"x"}}},
+		{"multipart fields", true, [][2]string{{"a", "1"}, {"a", "2"}}, nil, map[string][]string{"a": {"1", "2"}}},
+		{"uploads with the same name", true, nil, []upload{{"doc", "x.txt", "first"}, {"doc", "x.txt", "second"}}, nil},
+		{"fields and uploads", true, [][2]string{{"note", "hi"}}, []upload{{"img", "a.gif", "GIF89a..."}, {"doc", "b.txt", "text"}}, map[string][]string{"note": {"hi"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			contentType := "application/x-www-form-urlencoded"
+			if tt.multipart {
+				mw := multipart.NewWriter(&body)
+				for _, f := range tt.fields {
+					mw.WriteField(f[0], f[1])
+				}
+				for _, u := range tt.uploads {
+					fw, _ := mw.CreateFormFile(u.field, u.filename)
+					io.WriteString(fw, u.content)
+				}
+				mw.Close()
+				contentType = mw.FormDataContentType()
+			} else {
+				form := url.Values{}
+				for _, f := range tt.fields {
+					form.Add(f[0], f[1])
+				}
+				body.WriteString(form.Encode())
+			}
+
+			type received struct {
+				req      RequestMsg
+				contents []string
+			}
+			got := make(chan received, 1)
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				rcv := received{req: req}
+				for _, fi := range req.Files {
+					b, _ := os.ReadFile(fi.Path)
+					os.Remove(fi.Path) // External process owns it
+					rcv.contents = append(rcv.contents, string(b))
+				}
+				got <- rcv
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/form", SocketFile: sock, Timeout: 60, AllowedMethods: []string{http.MethodPost}})
+
+			r := httptest.NewRequest(http.MethodPost, "/form", &body)
+			r.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusAccepted)
+			}
+
+			rcv := <-got
+			want, _ := json.Marshal(tt.body)
+			if tt.body == nil {
+				want = []byte("[]")
+			}
+			if b, _ := json.Marshal(rcv.req.Body); string(b) != string(want) {
+				t.Errorf("body = %s, want %s", b, want)
+			}
+			// Sorted by field, in upload order within a field
+			wantUploads := slices.Clone(tt.uploads)
+			slices.SortStableFunc(wantUploads, func(a, b upload) int { return strings.Compare(a.field, b.field) })
+			if len(rcv.req.Files) != len(wantUploads) {
+				t.Fatalf("files = %+v, want %d", rcv.req.Files, len(wantUploads))
+			}
+			for i, u := range wantUploads {
+				fi := rcv.req.Files[i]
+				sum := sha256.Sum256([]byte(u.content))
+				if fi.Field != u.field || fi.Filename != u.filename || fi.Size != int64(len(u.content)) || fi.Sha256 != hex.EncodeToString(sum[:]) {
+					t.Errorf("file %d = %+v, want %+v", i, fi, u)
+				}
+				if fi.ContentType != http.DetectContentType([]byte(u.content)) || fi.DeclaredContentType != "application/octet-stream" {
+					t.Errorf("file %d content types = %q, %q", i, fi.ContentType, fi.DeclaredContentType)
+				}
+				if rcv.contents[i] != u.content {
+					t.Errorf("file %d content = %q, want %q", i, rcv.contents[i], u.content)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	large := `{"a":"` + strings.Repeat("x", int(spillThreshold)) + `"}`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, `{"a":"`+strings.Repeat("x", 200)+`"}`)
+	zw.Close()
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("doc", "a.txt")
+	io.WriteString(fw, strings.Repeat("x", 200))
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		limit       int64
+		contentType string
+		encoding    string
+		body        []byte
+		status      int
+		spilled     bool
+	}{
+		{"json", 100, "application/json", "", []byte(`{"a":1}`), http.StatusAccepted, false},
+		{"json over the limit", 100, "application/json", "", []byte(large), http.StatusRequestEntityTooLarge, false},
+		{"json over the spill threshold", 0, "application/json", "", []byte(large), http.StatusAccepted, true},
+		{"text over the limit", 100, "text/plain", "", bytes.Repeat([]byte("x"), 200), http.StatusRequestEntityTooLarge, false},
+		{"form over the limit", 100, "application/x-www-form-urlencoded", "", []byte("a=" + strings.Repeat("x", 200)), http.StatusRequestEntityTooLarge, false},
+		{"multipart over the limit", 100, mw.FormDataContentType(), "", form.Bytes(), http.StatusRequestEntityTooLarge, false},
+		{"multipart malformed", 0, "multipart/form-data; boundary=x", "", []byte("not multipart"), http.StatusBadRequest, false},
+		{"gzip over the limit once decoded", int64(gz.Len()) + 10, "application/json", "gzip", gz.Bytes(), http.StatusRequestEntityTooLarge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayed := make(chan RequestMsg, 1)
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				if req.BodyFile != "" {
+					os.Remove(req.BodyFile) // External process owns it
+				}
+				relayed <- req
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/in", SocketFile: sock, Timeout: 60, AllowedMethods: []string{http.MethodPost}, ContentTypes: []string{strings.Split(tt.contentType, ";")[0]}, MaxBodySize: tt.limit})
+
+			r := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.status == http.StatusRequestEntityTooLarge && !strings.Contains(w.Body.String(), "Request max size is") {
+				t.Errorf("body = %s, want the limit", w.Body)
+			}
+			if tt.status != http.StatusAccepted {
+				return
+			}
+			if req := <-relayed; (req.BodyFile != "") != tt.spilled || (req.Body != nil) == tt.spilled {
+				t.Errorf("body file = %q, body set %v, want spilled %v", req.BodyFile, req.Body != nil, tt.spilled)
+			}
+		})
+	}
+
+	sock := fakeHandler(t, func(req RequestMsg) ResponseMsg { return ResponseMsg{Ok: true} })
+	if reply := register(Command{Command: "register", Path: "/big", SocketFile: sock, ExternalProcessID: "test", Timeout: 60, MaxBodySize: maxBodySize + 1}, NewMux()); reply.Error != "invalid max body size" {
+		t.Errorf("register above the server limit error = %q, want %q", reply.Error, "invalid max body size")
+	}
+}
+
+func TestOwnerReaping(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval int
+		sender   string        // External process ID of the heartbeat, "" => none sent
+		beat     time.Duration // When the heartbeat arrives, after registration
+		check    time.Duration // When housekeeping looks at the resource
+		removed  bool
+	}{
+		{"no heartbeats expected", 0, "", 0, time.Hour, false},
+		{"silent for less than 3 intervals", 1, "", 0, 2 * time.Second, false},
+		{"silent for 3 intervals", 1, "", 0, 3 * time.Second, true},
+		{"heartbeat received", 1, "test", 2 * time.Second, 4 * time.Second, false},
+		{"silent after the heartbeat", 1, "test", 2 * time.Second, 5 * time.Second, true},
+		{"heartbeat from another process", 1, "other", 2 * time.Second, 4 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg { return ResponseMsg{Ok: true} })
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/hb", SocketFile: sock, Mode: modePersistent, HeartbeatInterval: tt.interval})
+			e := mux.handlers["/hb"]
+			e.mu.Lock()
+			start := e.LastSeen
+			e.mu.Unlock()
+
+			if tt.sender != "" {
+				reply := heartbeat(Command{Command: "heartbeat", ExternalProcessID: tt.sender}, mux)
+				if reply.Ok != (tt.sender == "test") {
+					t.Fatalf("heartbeat reply = %+v", reply)
+				}
+				if reply.Ok {
+					e.mu.Lock()
+					e.LastSeen = start.Add(tt.beat)
+					e.mu.Unlock()
+				}
+			}
+			mux.mu.Lock()
+			removeDue(mux, start.Add(tt.check))
+			_, found := mux.handlers["/hb"]
+			mux.mu.Unlock()
+			if found == tt.removed {
+				t.Errorf("removed = %v, want %v", !found, tt.removed)
+			}
+		})
+	}
+}
+
+func TestDeregisterAll(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string
+		via    string
+		err    string
+		remain []string
+	}{
+		{"owner", "a", "", "", []string{"/b1"}},
+		{"other owner", "b", "", "", []string{"/a1", "/a2"}},
+		{"unknown owner", "c", "", "resource not found", []string{"/a1", "/a2", "/b1"}},
+		{"other channel", "a", viaControlAPI, "resource not found", []string{"/a1", "/a2", "/b1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg { return ResponseMsg{Ok: true} })
+			mux := NewMux()
+			for _, r := range [][2]string{{"/a1", "a"}, {"/a2", "a"}, {"/b1", "b"}} {
+				mustRegister(t, mux, Command{Path: r[0], SocketFile: sock, ExternalProcessID: r[1], Timeout: 60})
+			}
+
+			reply := deregisterAll(Command{Command: "deregister_all", ExternalProcessID: tt.owner, via: tt.via}, mux)
+			if reply.Error != tt.err || (tt.err == "" && reply.Count != 3-len(tt.remain)) {
+				t.Errorf("reply = %+v, want error %q", reply, tt.err)
+			}
+			remain := slices.Sorted(maps.Keys(mux.handlers))
+			if !slices.Equal(remain, tt.remain) {
+				t.Errorf("remaining = %v, want %v", remain, tt.remain)
+			}
+		})
+	}
+}
+
+func TestRenew(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		timeout int // Registered
+		cmd     Command
+		err     string
+		expires time.Duration // From now, 0 => never
+	}{
+		{"renew", "", 60, Command{Command: "renew", Timeout: 120}, "", 120 * time.Second},
+		{"renew to the registered timeout", "", 60, Command{Command: "renew"}, "", 60 * time.Second},
+		{"touch", "", 60, Command{Command: "touch", Timeout: 120}, "", 60 * time.Second},
+		{"touch never expires", modePersistent, 0, Command{Command: "touch"}, "", 0},
+		{"renew persistent", modePersistent, 0, Command{Command: "renew", Timeout: 30}, "", 30 * time.Second},
+		{"negative timeout", "", 60, Command{Command: "renew", Timeout: -1}, "invalid timeout", 60 * time.Second},
+		{"wrong owner", "", 60, Command{Command: "renew", ExternalProcessID: "other", Timeout: 120}, "wrong resource owner", 60 * time.Second},
+		{"unknown path", "", 60, Command{Command: "renew", Path: "/missing", Timeout: 120}, "resource not found", 60 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg { return ResponseMsg{Ok: true} })
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/r", SocketFile: sock, Mode: tt.mode, Timeout: tt.timeout})
+
+			cmd := tt.cmd
+			if cmd.Path == "" {
+				cmd.Path = "/r"
+			}
+			if cmd.ExternalProcessID == "" {
+				cmd.ExternalProcessID = "test"
+			}
+			now := time.Now()
+			if reply := renew(cmd, mux); reply.Error != tt.err {
+				t.Fatalf("error = %q, want %q", reply.Error, tt.err)
+			}
+			e := mux.handlers["/r"]
+			e.mu.Lock()
+			deadline := e.Deadline
+			e.mu.Unlock()
+			if tt.expires == 0 && !deadline.IsZero() {
+				t.Errorf("deadline = %v, want never", deadline)
+			} else if tt.expires != 0 && (deadline.Before(now.Add(tt.expires-time.Second)) || deadline.After(now.Add(tt.expires+time.Second))) {
+				t.Errorf("deadline in %v, want %v", deadline.Sub(now), tt.expires)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     Command
+		err     string
+		methods []string
+		moved   bool // Requests go to the new socket file
+	}{
+		{"methods", Command{AllowedMethods: []string{http.MethodPost}}, "", []string{http.MethodPost}, false},
+		{"socket file", Command{SocketFile: "new"}, "", []string{http.MethodGet}, true},
+		{"nothing", Command{}, "nothing to update", []string{http.MethodGet}, false},
+		{"invalid method", Command{AllowedMethods: []string{http.MethodTrace}}, "invalid method", []string{http.MethodGet}, false},
+		{"wrong owner", Command{ExternalProcessID: "other", AllowedMethods: []string{http.MethodPost}}, "wrong resource owner", []string{http.MethodGet}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlers := map[string]string{}
+			for _, name := range []string{"old", "new"} {
+				handlers[name] = fakeHandler(t, func(req RequestMsg) ResponseMsg {
+					return ResponseMsg{RequestID: req.RequestID, Ok: true, HttpStatus: http.StatusOK, Body: name}
+				})
+			}
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/u", SocketFile: handlers["old"], Mode: modePersistent, Timeout: 60, AllowedMethods: []string{http.MethodGet}})
+
+			cmd := tt.cmd
+			cmd.Command, cmd.Path = "update", "/u"
+			if cmd.ExternalProcessID == "" {
+				cmd.ExternalProcessID = "test"
+			}
+			if cmd.SocketFile != "" {
+				cmd.SocketFile = handlers[cmd.SocketFile]
+			}
+			if reply := update(cmd, mux); reply.Error != tt.err {
+				t.Fatalf("error = %q, want %q", reply.Error, tt.err)
+			}
+
+			for _, m := range []string{http.MethodGet, http.MethodPost} {
+				r := httptest.NewRequest(m, "/u", strings.NewReader("{}"))
+				r.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				allowed := slices.Contains(tt.methods, m)
+				if allowed != (w.Code == http.StatusOK) {
+					t.Errorf("%s status = %d, want allowed %v", m, w.Code, allowed)
+				}
+				if want := map[bool]string{false: "old", true: "new"}[tt.moved]; allowed && w.Body.String() != want {
+					t.Errorf("%s relayed to %q, want %q", m, w.Body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	env, arg := filepath.Join(dir, "env.yaml"), filepath.Join(dir, "arg.yaml")
+	os.WriteFile(env, []byte("limits:\n  max_body_size: 100\n"), 0600)
+	os.WriteFile(arg, []byte("limits:\n  max_body_size: 200\n"), 0600)
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want int64
+	}{
+		{"defaults", nil, nil, 16 << 20},
+		{"environment", map[string]string{"FLOWS_HTTP_CONFIG": env}, nil, 100},
+		{"flag over environment", map[string]string{"FLOWS_HTTP_CONFIG": env}, []string{"--config", arg}, 200},
+		{"flag with value", nil, []string{"-config=" + arg}, 200},
+		{"setting over file", map[string]string{"FLOWS_HTTP_LIMITS_MAX_BODY_SIZE": "300"}, []string{"--config", arg}, 300},
+		{"after end of flags", nil, []string{"--", "--config", arg}, 16 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Limits.MaxBodySize != tt.want {
+				t.Errorf("max body size = %d, want %d", cfg.Limits.MaxBodySize, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdleShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		resource   bool
+		deregister bool // Last resource goes away
+		shutdown   bool
+	}{
+		{"ephemeral without resources", config.ModeEphemeral, false, false, true},
+		{"daemon without resources", config.ModeDaemon, false, false, false},
+		{"ephemeral with a resource", config.ModeEphemeral, true, false, false},
+		{"ephemeral after the last resource", config.ModeEphemeral, true, true, true},
+		{"daemon after the last resource", config.ModeDaemon, true, true, false},
+	}
+	defer func(mode string, idle time.Duration, sock string) {
+		serverMode, idleShutdown, cmdSockPath = mode, idle, sock
+	}(serverMode, idleShutdown, cmdSockPath)
+	serverMode, idleShutdown = "", 50*time.Millisecond
+	cmdSockPath = filepath.Join(t.TempDir(), "cmd.sock")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverMode = tt.mode
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg { return ResponseMsg{Ok: true} })
+			mux := NewMux()
+			registerPing(mux)
+			if tt.resource {
+				mustRegister(t, mux, Command{Path: "/r", SocketFile: sock, Mode: modePersistent})
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				housekeeping(ctx, cancel, mux)
+				close(done)
+			}()
+			if tt.deregister {
+				time.Sleep(2 * idleShutdown) // Busy for longer than the idle time
+				if reply := deregister(Command{Command: "deregister", Path: "/r", ExternalProcessID: "test"}, mux); !reply.Ok {
+					t.Fatal(reply.Error)
+				}
+			}
+
+			select {
+			case <-done:
+				if !tt.shutdown {
+					t.Error("server shut down")
+				}
+			case <-time.After(4 * idleShutdown):
+				if tt.shutdown {
+					t.Error("server did not shut down")
+				}
+				cancel()
+				<-done
+			}
+		})
+	}
+}
+
+func TestCustomResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		resp        ResponseMsg
+		status      int
+		contentType string
+		body        string
+		headers     map[string]string // "" => must not be set
+	}{
+		{"accepted", ResponseMsg{Ok: true, Message: "m"}, http.StatusAccepted, "application/json", `"message":"m"`, nil},
+		{"rejected", ResponseMsg{Ok: false}, http.StatusBadRequest, "application/json", `"ok":false`, nil},
+		{"status", ResponseMsg{Ok: true, HttpStatus: http.StatusCreated}, http.StatusCreated, "", "", nil},
+		{"status out of range", ResponseMsg{Ok: true, HttpStatus: 700}, http.StatusBadGateway, "", "", nil},
+		{"informational status", ResponseMsg{Ok: true, HttpStatus: 101}, http.StatusBadGateway, "", "", nil},
+		{"text body", ResponseMsg{Ok: true, HttpStatus: http.StatusOK, Body: "hi", ContentType: "text/plain"}, http.StatusOK, "text/plain", "hi", nil},
+		{"json body", ResponseMsg{Ok: true, HttpStatus: http.StatusOK, Body: map[string]int{"a": 1}}, http.StatusOK, "application/json", `{"a":1}`, nil},
+		{"headers", ResponseMsg{Ok: true, HttpStatus: http.StatusSeeOther, Headers: map[string][]string{"location": {"/next"}, "X-Trace\u200b": {"a\u200bb"}}}, http.StatusSeeOther, "", "", map[string]string{"Location": "/next", "X-Trace": "ab"}},
+		{"reserved headers", ResponseMsg{Ok: true, Body: "hello", Headers: map[string][]string{"Content-Length": {"1"}, "Connection": {"upgrade"}, "Upgrade": {"websocket"}}}, http.StatusAccepted, "", "hello", map[string]string{"Upgrade": ""}},
+		{"header injection", ResponseMsg{Ok: true, Headers: map[string][]string{"X-A": {"v\r\nSet-Cookie: s=1"}}}, http.StatusAccepted, "", "", map[string]string{"Set-Cookie": ""}},
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &HandlerEntry{SocketFile: "/tmp/h.sock"}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeResponse(w, r, tt.resp, e, nil)
+			}))
+			defer srv.Close()
+
+			res, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+			if ct := res.Header.Get("Content-Type"); tt.contentType != "" && !strings.HasPrefix(ct, tt.contentType) {
+				t.Errorf("content type = %q, want %q", ct, tt.contentType)
+			}
+			if !strings.Contains(string(body), tt.body) {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			for name, want := range tt.headers {
+				if got := res.Header.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestContentEncoding(t *testing.T) {
+	const data = `{"hello":"world"}`
+	compressed := func(coding string) []byte {
+		var buf bytes.Buffer
+		w := compress.NewWriter(coding, &buf)
+		io.WriteString(w, data)
+		w.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"gzip", "gzip", compressed(compress.Gzip), http.StatusAccepted},
+		{"deflate", "deflate", compressed(compress.Deflate), http.StatusAccepted},
+		{"brotli", "br", compressed(compress.Brotli), http.StatusAccepted},
+		{"unsupported", "compress", compressed(compress.Gzip), http.StatusUnsupportedMediaType},
+		{"not compressed", "gzip", []byte(data), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayed := make(chan RequestMsg, 1)
+			sock := fakeHandler(t, func(req RequestMsg) ResponseMsg {
+				relayed <- req
+				return ResponseMsg{RequestID: req.RequestID, Ok: true}
+			})
+			mux := NewMux()
+			mustRegister(t, mux, Command{Path: "/z", SocketFile: sock, Timeout: 60, AllowedMethods: []string{http.MethodPost}})
+
+			r := httptest.NewRequest(http.MethodPost, "/z", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			switch tt.status {
+			case http.StatusUnsupportedMediaType:
+				if w.Header().Get("Accept-Encoding") == "" {
+					t.Error("415 without Accept-Encoding")
+				}
+			case http.StatusAccepted:
+				// Relayed decoded, without the encoding headers
+				req := <-relayed
+				if b, _ := json.Marshal(req.Body); !strings.Contains(string(b), "world") || req.Headers["Content-Encoding"] != nil {
+					t.Errorf("body = %s, headers %v, want the decoded body", b, req.Headers)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// Listen on a unix socket file with the given mode, no umask on this platform
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
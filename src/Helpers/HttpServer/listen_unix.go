@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+/* Listen on a unix socket file with the given mode. The file is created owner only
+ * (umask), so it's never open to others before its mode is set. */
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,32 @@
+package peercred
+
+import (
+	"errors"
+	"slices"
+)
+
+// Credentials of the process on the other end of a unix socket connection
+type Cred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// Peer credentials are not available on this platform
+var ErrUnsupported = errors.New("peer credentials not supported")
+
+/* Policy decides which peers may use the socket: a peer is allowed if its
+ * uid or gid is listed. With both lists empty only the given default uid
+ * (the server's own) is allowed. */
+type Policy struct {
+	UIDs       []uint32
+	GIDs       []uint32
+	DefaultUID uint32
+}
+
+func (p *Policy) Allows(c Cred) bool {
+	if len(p.UIDs) == 0 && len(p.GIDs) == 0 {
+		return c.UID == p.DefaultUID
+	}
+	return slices.Contains(p.UIDs, c.UID) || slices.Contains(p.GIDs, c.GID)
+}
@@ -0,0 +1,39 @@
+//go:build linux
+
+package peercred
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Get reads the peer credentials (SO_PEERCRED) of a unix socket connection
+func Get(conn net.Conn) (Cred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return Cred{}, ErrUnsupported
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return Cred{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, serr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return Cred{}, err
+	} else if serr != nil {
+		return Cred{}, serr
+	}
+	return Cred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
+
+// Alive reports whether a process with this pid exists (it may belong to another user)
+func Alive(pid int32) bool {
+	err := syscall.Kill(int(pid), 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package peercred
+
+import "net"
+
+// Get is not implemented on this platform
+func Get(conn net.Conn) (Cred, error) {
+	return Cred{}, ErrUnsupported
+}
+
+// Alive can't tell on this platform, the process is assumed alive
+func Alive(pid int32) bool {
+	return true
+}
@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/* Entry is the state of one registered resource. The journal is append-only:
+ * every change appends the whole entry, the last line for a path wins. */
+type Entry struct {
+	Path      string          `json:"path"`
+	Removed   bool            `json:"removed,omitempty"`
+	Command   json.RawMessage `json:"command,omitempty"`    // Register command as accepted (final path, generated token)
+	ExpiresAt int64           `json:"expires_at,omitempty"` // Unix time, 0 => no timeout
+	Shots     int             `json:"shots,omitempty"`      // Accepted requests left, multi mode only
+	PeerPID   int32           `json:"peer_pid,omitempty"`   // Verified pid of the registering process
+	PeerUID   uint32          `json:"peer_uid,omitempty"`
+	Via       string          `json:"via,omitempty"` // Channel the resource was registered on
+}
+
+// Compact the journal when it has this many more lines than live entries
+const compactSlack = 1024
+
+type Registry struct {
+	path     string
+	mu       sync.Mutex
+	f        *os.File
+	live     map[string]Entry
+	appended int // Lines written since the last compaction
+}
+
+/* Open replays the journal (created if missing), compacts it and returns the live
+ * entries sorted by path. A truncated last line (crash while writing) is ignored. */
+func Open(path string) (*Registry, []Entry, error) {
+	r := &Registry{path: path, live: make(map[string]Entry)}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	} else if err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64<<10), 16<<20)
+		for sc.Scan() {
+			var e Entry
+			if json.Unmarshal(sc.Bytes(), &e) != nil || e.Path == "" {
+				continue
+			}
+			if e.Removed {
+				delete(r.live, e.Path)
+			} else {
+				r.live[e.Path] = e
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := r.compact(); err != nil {
+		return nil, nil, err
+	}
+	return r, r.entries(), nil
+}
+
+func (r *Registry) entries() []Entry {
+	entries := make([]Entry, 0, len(r.live))
+	for _, e := range r.live {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// Record the current state of a resource
+func (r *Registry) Put(e Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.live[e.Path] = e
+	return r.append(e)
+}
+
+// Record the removal of a resource
+func (r *Registry) Remove(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.live[path]; !ok {
+		return nil
+	}
+	delete(r.live, path)
+	return r.append(Entry{Path: path, Removed: true})
+}
+
+// Caller holds r.mu
+func (r *Registry) append(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := r.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	r.appended++
+	if r.appended > len(r.live)+compactSlack {
+		return r.compact()
+	}
+	return nil
+}
+
+/* Rewrite the journal with the live entries only: write a temporary file,
+ * sync it and rename it over the journal. Caller holds r.mu (or owns r). */
+func (r *Registry) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after rename
+
+	w := bufio.NewWriter(tmp)
+	for _, e := range r.entries() {
+		b, err := json.Marshal(e)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.f = f
+	r.appended = 0
+	return nil
+}
+
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func lines(t *testing.T, path string) int {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string // "" => no journal file
+		paths   []string
+		shots   []int
+	}{
+		{"no journal", "", nil, nil},
+		{"last line wins",
+			`{"path":"/a","shots":3}` + "\n" + `{"path":"/a","shots":2}` + "\n",
+			[]string{"/a"}, []int{2}},
+		{"removed",
+			`{"path":"/a"}` + "\n" + `{"path":"/b"}` + "\n" + `{"path":"/a","removed":true}` + "\n",
+			[]string{"/b"}, []int{0}},
+		{"registered again after removal",
+			`{"path":"/a","shots":1}` + "\n" + `{"path":"/a","removed":true}` + "\n" + `{"path":"/a","shots":5}` + "\n",
+			[]string{"/a"}, []int{5}},
+		{"sorted by path",
+			`{"path":"/c"}` + "\n" + `{"path":"/a"}` + "\n" + `{"path":"/b"}` + "\n",
+			[]string{"/a", "/b", "/c"}, []int{0, 0, 0}},
+		{"invalid lines skipped",
+			`{"path":"/a"}` + "\n" + `not json` + "\n" + `{"shots":1}` + "\n" + `{"path":"/b"}` + "\n",
+			[]string{"/a", "/b"}, []int{0, 0}},
+		{"truncated last line",
+			`{"path":"/a","shots":1}` + "\n" + `{"path":"/a","sho`,
+			[]string{"/a"}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "registry.jsonl")
+			if tt.journal != "" {
+				if err := os.WriteFile(path, []byte(tt.journal), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, entries, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			var paths []string
+			var shots []int
+			for _, e := range entries {
+				paths = append(paths, e.Path)
+				shots = append(shots, e.Shots)
+			}
+			if !slices.Equal(paths, tt.paths) || !slices.Equal(shots, tt.shots) {
+				t.Errorf("entries = %v %v, want %v %v", paths, shots, tt.paths, tt.shots)
+			}
+			// Compacted on open, one line per live entry
+			if n := lines(t, path); n != len(tt.paths) {
+				t.Errorf("journal has %d lines, want %d", n, len(tt.paths))
+			}
+		})
+	}
+}
+
+func TestPutRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.jsonl")
+	r, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Put(Entry{Path: "/a", Shots: 2})
+	r.Put(Entry{Path: "/b"})
+	r.Put(Entry{Path: "/a", Shots: 1})
+	r.Remove("/b")
+	r.Remove("/unknown") // Not written
+	if n := lines(t, path); n != 4 {
+		t.Errorf("journal has %d lines, want 4", n)
+	}
+	r.Close()
+
+	r, entries, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(entries) != 1 || entries[0].Path != "/a" || entries[0].Shots != 1 {
+		t.Errorf("entries = %+v, want /a with 1 shot", entries)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.jsonl")
+	r, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.Put(Entry{Path: "/keep"})
+	for i := range compactSlack + 1 {
+		if err := r.Put(Entry{Path: "/a", Shots: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := lines(t, path); n > len(r.live)+compactSlack {
+		t.Errorf("journal has %d lines, not compacted", n)
+	}
+
+	// Appends after compaction go to the new journal file
+	r.Put(Entry{Path: "/b"})
+	_, entries, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{Path: "/a", Shots: compactSlack}, {Path: "/b"}, {Path: "/keep"}}
+	if !slices.EqualFunc(entries, want, func(a, b Entry) bool { return a.Path == b.Path && a.Shots == b.Shots }) {
+		t.Errorf("entries = %+v, want %+v", entries, want)
+	}
+}
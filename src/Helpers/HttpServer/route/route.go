@@ -0,0 +1,186 @@
+package route
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// Segment kinds
+const (
+	literal = iota
+	param
+	wildcard
+)
+
+type segment struct {
+	kind  int
+	value string // literal text or parameter name
+}
+
+/* Pattern is a parsed resource path template, e.g.
+ *  - /orders/{id}/approve (one named parameter)
+ *  - /callbacks/*         (wildcard, matches the rest of the path)
+ * A path without parameters or wildcard is static and matches only itself. */
+type Pattern struct {
+	raw      string
+	segments []segment
+}
+
+// Name of the parameter holding what the wildcard matched
+const WildcardParam = "*"
+
+func Parse(path string) (*Pattern, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("path must start with /")
+	}
+
+	p := &Pattern{raw: path}
+	if path == "/" {
+		return p, nil
+	}
+
+	names := make(map[string]struct{})
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		switch {
+		case part == "*":
+			if i != len(parts)-1 {
+				return nil, errors.New("wildcard must be the last path segment")
+			}
+			p.segments = append(p.segments, segment{wildcard, WildcardParam})
+
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if !validName(name) {
+				return nil, errors.New("invalid path parameter name: " + part)
+			}
+			if _, dup := names[name]; dup {
+				return nil, errors.New("duplicate path parameter name: " + name)
+			}
+			names[name] = struct{}{}
+			p.segments = append(p.segments, segment{param, name})
+
+		case strings.ContainsAny(part, "{}*"):
+			return nil, errors.New("invalid path segment: " + part)
+
+		default:
+			p.segments = append(p.segments, segment{literal, part})
+		}
+	}
+	return p, nil
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func (p *Pattern) String() string {
+	return p.raw
+}
+
+// No parameters and no wildcard
+func (p *Pattern) IsStatic() bool {
+	for _, s := range p.segments {
+		if s.kind != literal {
+			return false
+		}
+	}
+	return true
+}
+
+/* Shape is the pattern with parameter names erased. Two patterns with the same
+ * shape match exactly the same paths, so they must not be registered together. */
+func (p *Pattern) Shape() string {
+	if len(p.segments) == 0 {
+		return p.raw
+	}
+
+	var b strings.Builder
+	for _, s := range p.segments {
+		b.WriteByte('/')
+		switch s.kind {
+		case literal:
+			b.WriteString(s.value)
+		case param:
+			b.WriteString("{}")
+		case wildcard:
+			b.WriteString("*")
+		}
+	}
+	return b.String()
+}
+
+/* Match reports whether path matches the pattern and returns the matched
+ * parameters (nil for static patterns). */
+func (p *Pattern) Match(path string) (map[string]string, bool) {
+	if p.IsStatic() {
+		return nil, path == p.raw
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	parts := strings.Split(path[1:], "/")
+	for i, s := range p.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch s.kind {
+		case wildcard:
+			params[s.value] = strings.Join(parts[i:], "/")
+			return params, true
+		case literal:
+			if parts[i] != s.value {
+				return nil, false
+			}
+		case param:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[s.value] = parts[i]
+		}
+	}
+	if len(parts) != len(p.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+/* Less orders patterns from most to least specific, so that when several
+ * patterns match the same path the first one wins:
+ * literal segments beat parameters, parameters beat the wildcard, and
+ * longer patterns beat shorter ones. */
+func Less(a, b *Pattern) bool {
+	n := min(len(a.segments), len(b.segments))
+	for i := range n {
+		if a.segments[i].kind != b.segments[i].kind {
+			return a.segments[i].kind < b.segments[i].kind
+		}
+	}
+	if len(a.segments) != len(b.segments) {
+		return len(a.segments) > len(b.segments)
+	}
+	return a.raw < b.raw
+}
+
+// Cryptographically random path segment (256 bits), for unguessable paths
+func RandomSegment() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
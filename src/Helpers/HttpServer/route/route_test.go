@@ -0,0 +1,127 @@
+package route
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"/", true},
+		{"/orders", true},
+		{"/orders/{id}/approve", true},
+		{"/callbacks/*", true},
+		{"/a/{x}/{y_2}", true},
+		{"orders", false},
+		{"/callbacks/*/more", false},
+		{"/orders/{}", false},
+		{"/orders/{1id}", false},
+		{"/orders/{id}/{id}", false},
+		{"/orders/x{id}", false},
+		{"/orders/a*", false},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse(%q) error = %v, want ok %v", tt.path, err, tt.ok)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		ok      bool
+		params  map[string]string
+	}{
+		{"/orders", "/orders", true, nil},
+		{"/orders", "/orders/", false, nil},
+		{"/orders/{id}/approve", "/orders/42/approve", true, map[string]string{"id": "42"}},
+		{"/orders/{id}/approve", "/orders//approve", false, nil},
+		{"/orders/{id}/approve", "/orders/42", false, nil},
+		{"/orders/{id}/approve", "/orders/42/approve/x", false, nil},
+		{"/orders/{id}/approve", "/orders/42/reject", false, nil},
+		{"/callbacks/*", "/callbacks/a/b/c", true, map[string]string{"*": "a/b/c"}},
+		{"/callbacks/*", "/callbacks/", true, map[string]string{"*": ""}},
+		{"/callbacks/*", "/callbacks", false, nil},
+		{"/{a}/{b}", "/x/y", true, map[string]string{"a": "x", "b": "y"}},
+		{"/{a}", "x", false, nil},
+	}
+	for _, tt := range tests {
+		p, err := Parse(tt.pattern)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.pattern, err)
+		}
+		params, ok := p.Match(tt.path)
+		if ok != tt.ok {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.pattern, tt.path, ok, tt.ok)
+		} else if ok && !maps.Equal(params, tt.params) {
+			t.Errorf("%q.Match(%q) params = %v, want %v", tt.pattern, tt.path, params, tt.params)
+		}
+	}
+}
+
+func TestShape(t *testing.T) {
+	a, _ := Parse("/orders/{id}/approve")
+	b, _ := Parse("/orders/{order}/approve")
+	c, _ := Parse("/orders/*")
+	if a.Shape() != b.Shape() {
+		t.Errorf("%q and %q must have the same shape", a, b)
+	}
+	if a.Shape() == c.Shape() {
+		t.Errorf("%q and %q must not have the same shape", a, c)
+	}
+}
+
+func TestLess(t *testing.T) {
+	// Most specific first
+	want := []string{
+		"/orders/new/approve",
+		"/orders/new",
+		"/orders/{id}/approve",
+		"/orders/{id}",
+		"/orders/*",
+		"/{section}/new",
+		"/*",
+	}
+	var patterns []*Pattern
+	for _, path := range slices.Backward(want) {
+		p, err := Parse(path)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", path, err)
+		}
+		patterns = append(patterns, p)
+	}
+	slices.SortFunc(patterns, func(a, b *Pattern) int {
+		if Less(a, b) {
+			return -1
+		} else if Less(b, a) {
+			return 1
+		}
+		return 0
+	})
+	for i, p := range patterns {
+		if p.String() != want[i] {
+			t.Errorf("position %d = %q, want %q", i, p, want[i])
+		}
+	}
+}
+
+func TestRandomSegment(t *testing.T) {
+	a, err := RandomSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := RandomSegment()
+	if len(a) != 43 || a == b {
+		t.Errorf("RandomSegment() = %q, %q, want two different 43 character segments", a, b)
+	}
+	if p, err := Parse("/" + a); err != nil || !p.IsStatic() {
+		t.Errorf("random segment %q is not a static path segment", a)
+	}
+}
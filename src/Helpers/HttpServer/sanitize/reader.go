@@ -0,0 +1,53 @@
+package sanitize
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+/* Reader strips invisible runes from the underlying reader content, like StripInvisibleBytes
+ * (or StripInvisibleText, keeping tabs and line breaks) but without reading it all at once. */
+type Reader struct {
+	src     io.Reader
+	strip   func([]byte) []byte
+	buf     []byte
+	pending []byte // Incomplete rune at the end of the last read
+	out     []byte
+	err     error
+}
+
+func NewReader(src io.Reader, text bool) *Reader {
+	r := &Reader{src: src, strip: StripInvisibleBytes, buf: make([]byte, 32<<10)}
+	if text {
+		r.strip = StripInvisibleText
+	}
+	return r
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		n, err := r.src.Read(r.buf)
+		data := append(r.pending, r.buf[:n]...)
+		cut := len(data)
+		if err == nil {
+			// Keep a rune split between reads for the next one
+			for i := max(0, len(data)-utf8.UTFMax); i < len(data); i++ {
+				if utf8.RuneStart(data[i]) && !utf8.FullRune(data[i:]) {
+					cut = i
+					break
+				}
+			}
+		}
+		r.pending = append([]byte(nil), data[cut:]...)
+		r.out = r.strip(data[:cut])
+		r.err = err
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
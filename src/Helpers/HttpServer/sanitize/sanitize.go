@@ -72,3 +72,27 @@ func StripInvisibleBytes(b []byte) []byte {
 	}
 	return out
 }
+
+// Same as StripInvisibleBytes but keeps tabs and line breaks, for text content
+func StripInvisibleText(b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+
+	out := make([]byte, 0, len(b))
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			// Invalid UTF-8 byte – keep it so we don't corrupt binary data
+			out = append(out, b[0])
+			b = b[1:]
+			continue
+		}
+
+		if _, blocked := invisibleRuneSet[r]; !blocked || r == '\t' || r == '\n' || r == '\r' {
+			out = append(out, b[:size]...)
+		}
+		b = b[size:]
+	}
+	return out
+}
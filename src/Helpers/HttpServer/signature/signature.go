@@ -0,0 +1,185 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verification schemes
+const (
+	HmacSha256 = "hmac-sha256" // Generic, HMAC-SHA256 of the raw body (or "timestamp.body") in a header
+	GitHub     = "github"      // X-Hub-Signature-256: sha256=<hex>
+	Stripe     = "stripe"      // Stripe-Signature: t=<timestamp>,v1=<hex>[,v1=<hex>]
+	Slack      = "slack"       // X-Slack-Signature: v0=<hex>, X-Slack-Request-Timestamp: <timestamp>
+)
+
+// Seconds, default accepted difference between the request timestamp and now
+const DefaultTolerance = 300
+
+var ErrInvalid = errors.New("invalid signature")
+
+/* Options of the signature verification of a resource, set in the register command.
+ * Header, Prefix, Encoding and TimestampHeader are only used by the generic scheme. */
+type Options struct {
+	Scheme          string `json:"scheme"`
+	Secret          string `json:"secret"`
+	Header          string `json:"header,omitempty"`           // Signature header
+	Prefix          string `json:"prefix,omitempty"`           // Signature header value prefix, e.g. sha256=
+	Encoding        string `json:"encoding,omitempty"`         // Signature encoding, hex (default) or base64
+	TimestampHeader string `json:"timestamp_header,omitempty"` // Signed timestamp header, optional
+	Tolerance       int    `json:"tolerance,omitempty"`        // Seconds, 0 => DefaultTolerance
+}
+
+func (o *Options) Validate() error {
+	if o.Secret == "" {
+		return errors.New("signature secret is mandatory")
+	}
+	if o.Tolerance < 0 {
+		return errors.New("invalid signature tolerance")
+	}
+
+	switch o.Scheme {
+	case HmacSha256:
+		if o.Header == "" {
+			return errors.New("signature header is mandatory")
+		}
+		if o.Encoding != "" && o.Encoding != "hex" && o.Encoding != "base64" {
+			return errors.New("invalid signature encoding")
+		}
+	case GitHub, Stripe, Slack:
+	default:
+		return errors.New("invalid signature scheme")
+	}
+	return nil
+}
+
+// Check the request signature, body is the raw request body
+func Verify(o *Options, h http.Header, body io.Reader, now time.Time) error {
+	switch o.Scheme {
+	case HmacSha256:
+		sig := strings.TrimPrefix(strings.TrimSpace(h.Get(o.Header)), o.Prefix)
+		prefix := ""
+		if o.TimestampHeader != "" {
+			ts := strings.TrimSpace(h.Get(o.TimestampHeader))
+			if err := checkTimestamp(ts, o.tolerance(), now); err != nil {
+				return err
+			}
+			prefix = ts + "."
+		}
+		mac, err := sum(o.Secret, prefix, body)
+		if err != nil {
+			return err
+		}
+		var expected string
+		if o.Encoding == "base64" {
+			expected = base64.StdEncoding.EncodeToString(mac)
+		} else {
+			expected = hex.EncodeToString(mac)
+			sig = strings.ToLower(sig)
+		}
+		return compare(sig, expected)
+
+	case GitHub:
+		sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return ErrInvalid
+		}
+		mac, err := sum(o.Secret, "", body)
+		if err != nil {
+			return err
+		}
+		return compare(strings.ToLower(sig), hex.EncodeToString(mac))
+
+	case Stripe:
+		var ts string
+		var sigs []string
+		for _, kv := range strings.Split(h.Get("Stripe-Signature"), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			switch k {
+			case "t":
+				ts = v
+			case "v1":
+				sigs = append(sigs, v)
+			}
+		}
+		if err := checkTimestamp(ts, o.tolerance(), now); err != nil {
+			return err
+		}
+		mac, err := sum(o.Secret, ts+".", body)
+		if err != nil {
+			return err
+		}
+		expected := hex.EncodeToString(mac)
+		for _, sig := range sigs {
+			if compare(sig, expected) == nil {
+				return nil
+			}
+		}
+		return ErrInvalid
+
+	case Slack:
+		ts := h.Get("X-Slack-Request-Timestamp")
+		if err := checkTimestamp(ts, o.tolerance(), now); err != nil {
+			return err
+		}
+		sig, ok := strings.CutPrefix(h.Get("X-Slack-Signature"), "v0=")
+		if !ok {
+			return ErrInvalid
+		}
+		mac, err := sum(o.Secret, "v0:"+ts+":", body)
+		if err != nil {
+			return err
+		}
+		return compare(sig, hex.EncodeToString(mac))
+	}
+	return ErrInvalid
+}
+
+func (o *Options) tolerance() int {
+	if o.Tolerance == 0 {
+		return DefaultTolerance
+	}
+	return o.Tolerance
+}
+
+// Unix timestamp (seconds) must be within tolerance of now, protects against replays
+func checkTimestamp(ts string, tolerance int, now time.Time) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid signature timestamp")
+	}
+	diff := now.Unix() - sec
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > int64(tolerance) {
+		return errors.New("signature timestamp out of tolerance")
+	}
+	return nil
+}
+
+// HMAC-SHA256 of prefix followed by body
+func sum(secret string, prefix string, body io.Reader) ([]byte, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(prefix))
+	if _, err := io.Copy(mac, body); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+// Constant time comparison
+func compare(sig, expected string) error {
+	if sig == "" || !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrInvalid
+	}
+	return nil
+}
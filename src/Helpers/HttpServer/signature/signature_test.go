@@ -0,0 +1,108 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	secret = "s3cret"
+	body   = `{"event":"paid"}`
+)
+
+func mac(payload string) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+func hexMac(payload string) string {
+	return hex.EncodeToString(mac(payload))
+}
+
+func header(kv ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i < len(kv); i += 2 {
+		h.Set(kv[i], kv[i+1])
+	}
+	return h
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Unix()-DefaultTolerance-1, 10)
+	future := strconv.FormatInt(now.Unix()+DefaultTolerance+1, 10)
+	generic := Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature"}
+
+	tests := []struct {
+		name string
+		opts Options
+		h    http.Header
+		ok   bool
+	}{
+		{"generic hex", generic, header("X-Signature", hexMac(body)), true},
+		{"generic hex upper case", generic, header("X-Signature", strings.ToUpper(hexMac(body))), true},
+		{"generic wrong secret", generic, header("X-Signature", hex.EncodeToString(hmac.New(sha256.New, []byte("x")).Sum(nil))), false},
+		{"generic missing header", generic, header(), false},
+		{"generic prefix", Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", Prefix: "sha256="}, header("X-Signature", "sha256="+hexMac(body)), true},
+		{"generic base64", Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", Encoding: "base64"}, header("X-Signature", base64.StdEncoding.EncodeToString(mac(body))), true},
+		{"generic base64 given hex", Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", Encoding: "base64"}, header("X-Signature", hexMac(body)), false},
+		{"generic timestamp", Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", TimestampHeader: "X-Timestamp"}, header("X-Signature", hexMac(ts+"."+body), "X-Timestamp", ts), true},
+		{"generic timestamp not signed", Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", TimestampHeader: "X-Timestamp"}, header("X-Signature", hexMac(body), "X-Timestamp", ts), false},
+		{"generic timestamp too old", Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", TimestampHeader: "X-Timestamp"}, header("X-Signature", hexMac(old+"."+body), "X-Timestamp", old), false},
+
+		{"github", Options{Scheme: GitHub, Secret: secret}, header("X-Hub-Signature-256", "sha256="+hexMac(body)), true},
+		{"github without prefix", Options{Scheme: GitHub, Secret: secret}, header("X-Hub-Signature-256", hexMac(body)), false},
+		{"github bad signature", Options{Scheme: GitHub, Secret: secret}, header("X-Hub-Signature-256", "sha256="+hexMac(body+" ")), false},
+
+		{"stripe", Options{Scheme: Stripe, Secret: secret}, header("Stripe-Signature", "t="+ts+",v1="+hexMac(ts+"."+body)), true},
+		{"stripe second v1", Options{Scheme: Stripe, Secret: secret}, header("Stripe-Signature", "t="+ts+",v1=00,v1="+hexMac(ts+"."+body)), true},
+		{"stripe bad signature", Options{Scheme: Stripe, Secret: secret}, header("Stripe-Signature", "t="+ts+",v1="+hexMac(body)), false},
+		{"stripe too old", Options{Scheme: Stripe, Secret: secret}, header("Stripe-Signature", "t="+old+",v1="+hexMac(old+"."+body)), false},
+		{"stripe in the future", Options{Scheme: Stripe, Secret: secret}, header("Stripe-Signature", "t="+future+",v1="+hexMac(future+"."+body)), false},
+		{"stripe custom tolerance", Options{Scheme: Stripe, Secret: secret, Tolerance: 2 * DefaultTolerance}, header("Stripe-Signature", "t="+old+",v1="+hexMac(old+"."+body)), true},
+		{"stripe without timestamp", Options{Scheme: Stripe, Secret: secret}, header("Stripe-Signature", "v1="+hexMac("."+body)), false},
+
+		{"slack", Options{Scheme: Slack, Secret: secret}, header("X-Slack-Signature", "v0="+hexMac("v0:"+ts+":"+body), "X-Slack-Request-Timestamp", ts), true},
+		{"slack bad signature", Options{Scheme: Slack, Secret: secret}, header("X-Slack-Signature", "v0="+hexMac(body), "X-Slack-Request-Timestamp", ts), false},
+		{"slack too old", Options{Scheme: Slack, Secret: secret}, header("X-Slack-Signature", "v0="+hexMac("v0:"+old+":"+body), "X-Slack-Request-Timestamp", old), false},
+
+		{"unknown scheme", Options{Scheme: "md5", Secret: secret}, header(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(&tt.opts, tt.h, strings.NewReader(body), now)
+			if (err == nil) != tt.ok {
+				t.Errorf("Verify() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		opts Options
+		ok   bool
+	}{
+		{Options{Scheme: GitHub, Secret: secret}, true},
+		{Options{Scheme: GitHub}, false},
+		{Options{Scheme: Stripe, Secret: secret, Tolerance: -1}, false},
+		{Options{Scheme: HmacSha256, Secret: secret}, false},
+		{Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", Encoding: "base32"}, false},
+		{Options{Scheme: HmacSha256, Secret: secret, Header: "X-Signature", Encoding: "base64"}, true},
+		{Options{Scheme: "md5", Secret: secret}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v Validate() = %v, want ok %v", tt.opts, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package spool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	mrand "math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	expiry "flows.local/http-server/expiry"
+)
+
+// Message waiting for delivery, one file per message in the spool directory
+type Message struct {
+	ID          string          `json:"id"`
+	Route       string          `json:"route"`    // Resource the message is for
+	Attempts    int             `json:"attempts"` // Failed delivery attempts
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Payload     json.RawMessage `json:"payload"`         // Message to deliver, as is
+	Files       []string        `json:"files,omitempty"` // Kept files the payload refers to, see Keep
+}
+
+type Options struct {
+	Dir           string
+	DeadLetterDir string        // Messages that were not delivered after MaxAttempts, default Dir/dead-letter
+	MaxAttempts   int           // Delivery attempts, including the first one, at least 2
+	Backoff       time.Duration // Wait after the first failed attempt, doubled after each one
+	MaxBackoff    time.Duration
+}
+
+/* Spool keeps messages until they are delivered. Files are written to a temporary
+ * name, synced and renamed, so a crash leaves the previous or the new version.
+ * The owner waits for the Next attempt (or a Wake signal) and delivers the Due messages. */
+type Spool struct {
+	opts     Options
+	mu       sync.Mutex
+	messages map[string]*Message // ID => message, not being delivered
+	attempts *expiry.Queue
+}
+
+const ext = ".json"
+
+// Subdirectory of the spool (and dead letter) directory for kept files
+const filesDir = "files"
+
+/* Open the spool (directories are created if missing) and schedule the messages
+ * found in it. Unreadable message files are moved to the dead letter directory. */
+func Open(opts Options) (*Spool, error) {
+	if opts.DeadLetterDir == "" {
+		opts.DeadLetterDir = filepath.Join(opts.Dir, "dead-letter")
+	}
+	for _, dir := range []string{filepath.Join(opts.Dir, filesDir), filepath.Join(opts.DeadLetterDir, filesDir)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Spool{opts: opts, messages: make(map[string]*Message), attempts: expiry.New()}
+	files, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			continue
+		} else if strings.HasPrefix(name, ".tmp-") {
+			os.Remove(filepath.Join(opts.Dir, name)) // Crash while writing
+			continue
+		} else if !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		var m Message
+		b, err := os.ReadFile(filepath.Join(opts.Dir, name))
+		if err == nil {
+			err = json.Unmarshal(b, &m)
+		}
+		if err != nil || m.ID+ext != name {
+			os.Rename(filepath.Join(opts.Dir, name), filepath.Join(opts.DeadLetterDir, name))
+			continue
+		}
+		s.messages[m.ID] = &m
+		s.attempts.Schedule(m.ID, m.NextAttempt)
+	}
+	return s, nil
+}
+
+/* Move files into the spool (e.g. temporary files that are removed at restart) and
+ * return their new paths, for the payload of the message that refers to them.
+ * Nothing is kept on error, files not moved yet are left where they are. */
+func (s *Spool) Keep(files []string) ([]string, error) {
+	kept := make([]string, 0, len(files))
+	for _, f := range files {
+		dst := filepath.Join(s.opts.Dir, filesDir, filepath.Base(f))
+		if err := move(f, dst); err != nil {
+			removeAll(kept)
+			return nil, err
+		}
+		kept = append(kept, dst)
+	}
+	return kept, nil
+}
+
+/* Store a message whose first delivery attempt failed, with the files it refers to
+ * (from Keep). The files are removed if the message can't be stored. */
+func (s *Spool) Put(route string, payload any, files []string, reason error) (*Message, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		removeAll(files)
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		removeAll(files)
+		return nil, err
+	}
+
+	now := time.Now()
+	m := &Message{ID: hex.EncodeToString(id), Route: route, Attempts: 1, NextAttempt: now.Add(s.backoff(1)), LastError: reason.Error(), CreatedAt: now, Payload: b, Files: files}
+	if err := s.write(m); err != nil {
+		removeAll(files)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.messages[m.ID] = m
+	s.mu.Unlock()
+	s.attempts.Schedule(m.ID, m.NextAttempt)
+	return m, nil
+}
+
+// Messages waiting for their next attempt, e.g. to count them
+func (s *Spool) Pending() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := make([]*Message, 0, len(s.messages))
+	for _, m := range s.messages {
+		pending = append(pending, m)
+	}
+	return pending
+}
+
+/* Take the messages due for delivery, earliest first. Each one must be
+ * settled with Delivered, Failed, Dead or Postpone. */
+func (s *Spool) Due(now time.Time) []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*Message
+	for _, id := range s.attempts.Due(now) {
+		if m := s.messages[id]; m != nil {
+			delete(s.messages, id)
+			due = append(due, m)
+		}
+	}
+	return due
+}
+
+// Earliest next attempt, false if the spool is empty
+func (s *Spool) Next() (time.Time, bool) {
+	return s.attempts.Next()
+}
+
+// Receives when a message is stored or rescheduled before the earliest next attempt
+func (s *Spool) Wake() <-chan struct{} {
+	return s.attempts.Wake()
+}
+
+// Message was delivered, remove its file. The receiver owns (and removes) the files of the message.
+func (s *Spool) Delivered(m *Message) error {
+	err := os.Remove(s.path(m))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+/* Delivery attempt failed: try again after the backoff, or move the message to
+ * the dead letter directory after MaxAttempts. Reports whether it was moved. */
+func (s *Spool) Failed(m *Message, reason error) (bool, error) {
+	m.Attempts++
+	m.LastError = reason.Error()
+	if m.Attempts >= s.opts.MaxAttempts {
+		return true, s.dead(m)
+	}
+	return false, s.Postpone(m, time.Now().Add(s.backoff(m.Attempts)))
+}
+
+// Delivery can never succeed (e.g. the receiver is gone), move the message to the dead letter directory at once
+func (s *Spool) Dead(m *Message, reason error) error {
+	m.Attempts++
+	m.LastError = reason.Error()
+	return s.dead(m)
+}
+
+// Try again at a later time without counting an attempt, e.g. the receiver is busy
+func (s *Spool) Postpone(m *Message, at time.Time) error {
+	m.NextAttempt = at
+	err := s.write(m)
+
+	s.mu.Lock()
+	s.messages[m.ID] = m
+	s.mu.Unlock()
+	s.attempts.Schedule(m.ID, m.NextAttempt)
+	return err
+}
+
+// Backoff doubled after every failed attempt, capped at MaxBackoff, up to 10% jitter
+func (s *Spool) backoff(attempts int) time.Duration {
+	d := s.opts.Backoff
+	for i := 1; i < attempts && d < s.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, s.opts.MaxBackoff)
+	return d + time.Duration(mrand.Int64N(int64(d)/10+1))
+}
+
+func (s *Spool) path(m *Message) string {
+	return filepath.Join(s.opts.Dir, m.ID+ext)
+}
+
+// Write the message file atomically
+func (s *Spool) write(m *Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.opts.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after rename
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(m))
+}
+
+/* Move the message to the dead letter directory, with its last state and its files.
+ * Files lists their new paths, the payload still refers to the spool directory. */
+func (s *Spool) dead(m *Message) error {
+	files := make([]string, 0, len(m.Files))
+	for _, f := range m.Files {
+		dst := filepath.Join(s.opts.DeadLetterDir, filesDir, filepath.Base(f))
+		if err := os.Rename(f, dst); err != nil {
+			dst = f
+		}
+		files = append(files, dst)
+	}
+	m.Files = files
+	if err := s.write(m); err != nil {
+		return err
+	}
+	return os.Rename(s.path(m), filepath.Join(s.opts.DeadLetterDir, m.ID+ext))
+}
+
+// Rename the file, or copy it when the destination is on another file system
+func move(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func removeAll(files []string) {
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
@@ -0,0 +1,158 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, dir string) *Spool {
+	t.Helper()
+	s, err := Open(Options{Dir: dir, MaxAttempts: 2, Backoff: time.Millisecond, MaxBackoff: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Temporary file with some content, outside of the spool directory
+func tempFile(t *testing.T) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(f, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestKeep(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir)
+	src := tempFile(t)
+
+	kept, err := s.Keep([]string{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || filepath.Dir(kept[0]) != filepath.Join(dir, filesDir) {
+		t.Fatalf("Keep() = %v, want a file in the spool", kept)
+	}
+	if exists(src) || !exists(kept[0]) {
+		t.Error("file was not moved into the spool")
+	}
+
+	if _, err := s.Keep([]string{filepath.Join(dir, "missing"), kept[0]}); err == nil {
+		t.Error("Keep() of a missing file must fail")
+	}
+}
+
+func TestPutAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir)
+	kept, _ := s.Keep([]string{tempFile(t)})
+	m, err := s.Put("/r", map[string]string{"body_file": kept[0]}, kept, errors.New("dial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Attempts != 1 || m.LastError != "dial" || !m.NextAttempt.After(m.CreatedAt) {
+		t.Errorf("message = %+v, want one failed attempt", m)
+	}
+
+	// Messages and their files survive a restart
+	s = open(t, dir)
+	pending := s.Pending()
+	if len(pending) != 1 || pending[0].ID != m.ID || len(pending[0].Files) != 1 || !exists(pending[0].Files[0]) {
+		t.Fatalf("pending after reopen = %+v, want %s with its file", pending, m.ID)
+	}
+	var payload map[string]string
+	json.Unmarshal(pending[0].Payload, &payload)
+	if payload["body_file"] != kept[0] {
+		t.Errorf("payload = %v, want the kept file", payload)
+	}
+}
+
+func TestDeliveredAndDead(t *testing.T) {
+	tests := []struct {
+		name      string
+		delivered bool
+		dead      func(*Spool, *Message) error
+	}{
+		{"delivered", true, nil},
+		{"dead letter after max attempts", false, func(s *Spool, m *Message) error {
+			dead, err := s.Failed(m, errors.New("dial again"))
+			if err == nil && !dead {
+				err = errors.New("not moved after max attempts")
+			}
+			return err
+		}},
+		{"dead letter at once", false, func(s *Spool, m *Message) error {
+			return s.Dead(m, errors.New("gone"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := open(t, dir)
+			kept, _ := s.Keep([]string{tempFile(t)})
+			m, err := s.Put("/r", "payload", kept, errors.New("dial"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.delivered {
+				if err := s.Delivered(m); err != nil {
+					t.Fatal(err)
+				}
+				// The receiver owns the file now
+				if exists(s.path(m)) || !exists(kept[0]) {
+					t.Error("message file must be removed and its file kept")
+				}
+				return
+			}
+
+			if err := tt.dead(s, m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Attempts != 2 {
+				t.Errorf("attempts = %d, want 2", m.Attempts)
+			}
+			deadDir := filepath.Join(dir, "dead-letter")
+			if exists(s.path(m)) || !exists(filepath.Join(deadDir, m.ID+ext)) {
+				t.Error("message was not moved to the dead letter directory")
+			}
+			if exists(kept[0]) || len(m.Files) != 1 || filepath.Dir(m.Files[0]) != filepath.Join(deadDir, filesDir) || !exists(m.Files[0]) {
+				t.Errorf("files = %v, want them moved to the dead letter directory", m.Files)
+			}
+			if s = open(t, dir); len(s.Pending()) != 0 {
+				t.Error("dead letter must not be delivered again")
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &Spool{opts: Options{Backoff: time.Second, MaxBackoff: 5 * time.Second}}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if d := s.backoff(tt.attempts); d < tt.want || d > tt.want+tt.want/10 {
+			t.Errorf("backoff(%d) = %v, want %v plus at most 10%%", tt.attempts, d, tt.want)
+		}
+	}
+}
@@ -10,29 +10,46 @@ use JsonSerializable;
 readonly class ResponseMessageToHttpRequest extends IO implements JsonSerializable
 {
     /**
-     * @param bool $ok  External process signal, FALSE => respond with 400, TRUE => 200
+     * @param bool $ok  External process signal, FALSE => respond with 400, TRUE => 202
      * @param int $code Reserved for custom code
      * @param string $status Reserved for custom status message
      * @param string $message Reserved for custom message
+     * @param int $httpStatus HTTP response status code, 0 => 202 or 400 (see $ok)
+     * @param array<string, string[]> $headers HTTP response headers
+     * @param string $contentType HTTP response body content type
+     * @param mixed $body HTTP response body, strings are written as is, anything else as JSON
+     * @param string $bodyFile File with the HTTP response body, removed by the server after it's written: the request message
+     *                         response_file (register option 'response_file' => true) or one of the request's files
      */
     public function __construct(
         private bool $ok,
         private int $code,
         private string $status,
-        private string $message
+        private string $message,
+        private int $httpStatus = 0,
+        private array $headers = [],
+        private string $contentType = '',
+        private mixed $body = null,
+        private string $bodyFile = ''
     ) {}
 
     /**
-     * JSON object representation, plus instance unique identifier
+     * JSON object representation, plus instance unique identifier.
+     * When any HTTP response field is set the server writes it verbatim instead of this message.
      */
     public function jsonSerialize(): mixed
     {
-        return [
+        return array_filter([
             'ok' => $this->ok,
             'code' => $this->code,
             'status' => $this->status,
             'message' => $this->message,
-            'instance_uid' => INSTANCE_UID
-        ];
+            'instance_uid' => INSTANCE_UID,
+            'http_status' => $this->httpStatus ?: null,
+            'headers' => $this->headers ?: null,
+            'content_type' => $this->contentType ?: null,
+            'body' => $this->body,
+            'body_file' => $this->bodyFile ?: null
+        ], fn($value) => $value !== null);
     }
 }
@@ -81,18 +81,41 @@ class StartHttpServerProcess extends Process
                     $cmdSocketPath = $settings->get('http.server.command_socket_path');
                     $externalProcessReadTimeout = $settings->get('http.server.timeout_read_external_process');
                     $uid = $this->getHexadecimal(8);
+                    $command = [
+                        './http-server',
+                        '--address',
+                        $address,
+                        '--command-socket',
+                        $cmdSocketPath,
+                        '--server-uid',
+                        $uid,
+                        '--timeout-read-external-process',
+                        $externalProcessReadTimeout
+                    ];
+                    // Optional settings, server defaults apply if not set
+                    $optional = [
+                        'http.server.config_file' => '--config',
+                        'http.server.mode' => '--mode',
+                        'http.server.idle_shutdown' => '--idle-shutdown',
+                        'http.server.drain_timeout' => '--drain-timeout',
+                        'http.server.drain_poll' => '--drain-poll',
+                        'http.server.max_body_size' => '--max-body-size',
+                        'http.server.spill_threshold' => '--spill-threshold',
+                        'http.server.command_secret_file' => '--command-secret-file',
+                        'http.server.registry_file' => '--registry-file',
+                        'http.server.spool_dir' => '--spool-dir',
+                        'http.server.dead_letter_dir' => '--dead-letter-dir',
+                        'http.server.tls_cert' => '--tls-cert',
+                        'http.server.tls_key' => '--tls-key',
+                        'http.server.tls_client_ca' => '--tls-client-ca',
+                    ];
+                    foreach ($optional as $setting => $flag) {
+                        if ($settings->has($setting)) {
+                            array_push($command, $flag, (string)$settings->get($setting));
+                        }
+                    }
                     $httpServer = proc_open(
-                        [
-                            './http-server',
-                            '--address',
-                            $address,
-                            '--command-socket',
-                            $cmdSocketPath,
-                            '--server-uid',
-                            $uid,
-                            '--timeout-read-external-process',
-                            $externalProcessReadTimeout
-                        ],
+                        $command,
                         $descriptorSpec,
                         $pipes,
                         getcwd()
@@ -80,10 +80,17 @@ class Reactor
             }
             // Handle I/O
             foreach ($read as $r) {
+                if (!isset($this->readHandlers[(int)$r])) {
+                    // Removed by a handler called before this one (e.g. stopRun())
+                    continue;
+                }
                 [$stream, $handler] = $this->readHandlers[(int)$r];
                 $handler($stream, $this);
             }
             foreach ($write as $w) {
+                if (!isset($this->writeHandlers[(int)$w])) {
+                    continue;
+                }
                 [$stream, $handler] = $this->writeHandlers[(int)$w];
                 $handler($stream, $this);
             }
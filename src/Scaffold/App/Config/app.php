@@ -17,6 +17,36 @@ return [
             'address' => '0.0.0.0:9090',
             // Seconds, HTTP handler server timeout for a response from a Flows process
             'timeout_read_external_process' => 30,
+            // Bytes, maximum HTTP request body size (resources may set a lower limit)
+            'max_body_size' => 16 * 1024 * 1024,
+            // Bytes, larger HTTP request bodies are written to a file for the Flows process
+            'spill_threshold' => 1024 * 1024,
+            // HTTP helper server mode: ephemeral (shuts down when idle) or daemon (runs until stopped)
+            'mode' => 'ephemeral',
+            // Ephemeral mode, how long the HTTP helper server waits without resources before shutting down
+            'idle_shutdown' => '3s',
+            // On SIGINT/SIGTERM, how long the HTTP helper server waits for requests in flight, and how often it checks them
+            // 'drain_timeout' => '30s',
+            // 'drain_poll' => '50ms',
+            // HTTP helper server configuration file, .yaml, .json or .toml (optional, settings above take precedence)
+            // 'config_file' => '/path/to/http-server.yaml',
+            // File with the shared secret for command socket messages (optional, uncomment to enable)
+            // 'command_secret_file' => '/path/to/secret',
+            // Journal file, registered resources survive an HTTP helper server restart (optional, uncomment to enable)
+            // 'registry_file' => '/path/to/http-server.registry',
+            // Requests for unreachable Flows processes are stored and delivered later, resources opt in with
+            // the 'spool' register option (optional, uncomment to enable)
+            // 'spool_dir' => '/path/to/spool',
+            // 'dead_letter_dir' => '/path/to/spool/dead-letter',
+            // HTTPS listener, the certificate must name the host of the address above (optional, uncomment to enable)
+            // 'tls_cert' => '/path/to/server.crt',
+            // 'tls_key' => '/path/to/server.key',
+            // CA that issued the server certificate, used to ping the server (defaults to tls_cert, for self-signed certificates)
+            // 'tls_ca' => '/path/to/ca.crt',
+            // Mutual TLS: CA for client certificates, and the client certificate used to ping the server
+            // 'tls_client_ca' => '/path/to/client-ca.crt',
+            // 'tls_client_cert' => '/path/to/client.crt',
+            // 'tls_client_key' => '/path/to/client.key',
         ],
     ],
     'stop' => [
@@ -12,13 +12,15 @@ trait Echos
     /**
      * Check if HTTP handler server is running
      * 
-     * @param string|null $address IP address plus port. Protocol is always HTTP. Defaults to configuration "http.server.address" value
+     * @param string|null $address IP address plus port. Protocol is HTTPS when "http.server.tls_cert" is set, HTTP otherwise. Defaults to configuration "http.server.address" value
      * @throws InvalidArgumentException If provided address is not valid
      * @return bool TRUE => server reachable, FALSE => server not reachable
      */
     public function pingHandlerServer(?string $address = null): bool
     {
-        $urlPing = sprintf("http://%s/ping", $address ?? Config::getApplicationSettings()->get('http.server.address'));
+        $settings = Config::getApplicationSettings();
+        $tls = $settings->has('http.server.tls_cert');
+        $urlPing = sprintf("%s://%s/ping", $tls ? 'https' : 'http', $address ?? $settings->get('http.server.address'));
         if (false === filter_var($urlPing, FILTER_VALIDATE_URL)) {
             throw new InvalidArgumentException('Invalid URL for HTTP handler server');
         }
@@ -26,6 +28,15 @@ trait Echos
         $ch = curl_init($urlPing);
         curl_setopt($ch, CURLOPT_CONNECTTIMEOUT, 1);
         curl_setopt($ch, CURLOPT_RETURNTRANSFER, true);
+        if ($tls) {
+            // Server certificate checked against the configured CA, or itself when self-signed
+            curl_setopt($ch, CURLOPT_CAINFO, $settings->has('http.server.tls_ca') ? $settings->get('http.server.tls_ca') : $settings->get('http.server.tls_cert'));
+            if ($settings->has('http.server.tls_client_cert')) {
+                // Mutual TLS, the server refuses the handshake without a client certificate
+                curl_setopt($ch, CURLOPT_SSLCERT, $settings->get('http.server.tls_client_cert'));
+                curl_setopt($ch, CURLOPT_SSLKEY, $settings->get('http.server.tls_client_key'));
+            }
+        }
         $response = curl_exec($ch);
         unset($ch);
         return false === $response